@@ -26,6 +26,50 @@ func GetLLMCacheStats(c *gin.Context) {
 	})
 }
 
+// GetLLMCacheSemanticStats 获取语义缓存命中统计（精确命中 vs 语义命中）
+func GetLLMCacheSemanticStats(c *gin.Context) {
+	stats := model.GetLLMCacheSemanticStats()
+
+	total := stats.ExactHits + stats.SemanticHits + stats.Misses
+	var exactHitRate, semanticHitRate float64
+	if total > 0 {
+		exactHitRate = float64(stats.ExactHits) / float64(total) * 100
+		semanticHitRate = float64(stats.SemanticHits) / float64(total) * 100
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data": gin.H{
+			"stats":             stats,
+			"exact_hit_rate":    exactHitRate,
+			"semantic_hit_rate": semanticHitRate,
+		},
+	})
+}
+
+// DeleteLLMCacheByTag 按标签（model/user_id/channel_id/group）批量失效缓存，
+// 用于渠道下线、用户封禁或密钥轮换等场景，而不必清空整个缓存
+func DeleteLLMCacheByTag(c *gin.Context) {
+	var req struct {
+		Tag   string `json:"tag"`
+		Value string `json:"value"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || req.Tag == "" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"success": false,
+			"message": "无效的标签参数",
+		})
+		return
+	}
+
+	deleted := model.DeleteByTag(req.Tag, req.Value)
+
+	c.JSON(http.StatusOK, gin.H{
+		"success": true,
+		"data":    gin.H{"deleted": deleted},
+	})
+}
+
 // ClearLLMCache 清空缓存
 func ClearLLMCache(c *gin.Context) {
 	model.ClearLLMCache()
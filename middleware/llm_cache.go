@@ -2,10 +2,12 @@ package middleware
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/songquanpeng/one-api/common/logger"
@@ -13,45 +15,84 @@ import (
 	relaymodel "github.com/songquanpeng/one-api/relay/model"
 )
 
-// LLMCacheMiddleware LLM缓存中间件
+// X-OneAPI-Cache 请求头取值，语义参照HTTP Cache-Control
+const (
+	cacheControlBypass       = "bypass"         // 本次跳过缓存读取，但响应仍写入缓存供后续请求使用
+	cacheControlRefresh      = "refresh"        // 强制跳过缓存读取并回源，用新结果覆盖旧缓存项
+	cacheControlOnlyIfCached = "only-if-cached" // 只允许读缓存，未命中时直接返回504，不回源
+	cacheControlNoStore      = "no-store"       // 本次请求完全不读也不写缓存
+)
+
+// cacheControlExtension 请求体中可选的cache_control扩展字段，转发前会被剥离
+type cacheControlExtension struct {
+	TTL      int64             `json:"ttl,omitempty"`
+	KeyExtra string            `json:"key_extra,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"` // 可选覆盖user_id/channel_id/group等标签维度
+}
+
+// LLMCacheMiddleware LLM缓存中间件。同时支持非流式和stream=true的聊天完成请求：
+// 流式请求的SSE帧会通过responseCaptureWriter原样转发给客户端的同时被捕获下来，
+// 未命中缓存时在回源完成后重新拼装并连同原始帧序列一起存入缓存；命中时按
+// LLMCacheStreamReplayPacing的节奏把存好的SSE帧回放给客户端。
 func LLMCacheMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		// 只处理非流式的聊天完成请求
+		// 只处理聊天完成请求
 		if !isCacheableRequest(c) {
 			c.Next()
 			return
 		}
 
 		// 获取请求体
-		body, err := io.ReadAll(c.Request.Body)
+		rawBody, err := io.ReadAll(c.Request.Body)
 		if err != nil {
 			logger.Errorf(c.Request.Context(), "failed to read request body: %s", err.Error())
 			c.Next()
 			return
 		}
-		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		forwardBody, cacheControl := extractCacheControl(rawBody)
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(forwardBody))
+		c.Request.ContentLength = int64(len(forwardBody))
 
 		// 解析请求
 		var request relaymodel.GeneralOpenAIRequest
-		if err := json.Unmarshal(body, &request); err != nil {
+		if err := json.Unmarshal(forwardBody, &request); err != nil {
 			logger.Errorf(c.Request.Context(), "failed to unmarshal request: %s", err.Error())
 			c.Next()
 			return
 		}
 
+		if shouldExcludeFromCache(&request) {
+			logger.Debugf(c.Request.Context(), "request excluded from LLM cache (tools/functions/json_schema)")
+			c.Next()
+			return
+		}
+
+		if request.Stream && !model.LLMCacheStreamEnabled {
+			c.Next()
+			return
+		}
+
+		directive := strings.ToLower(c.GetHeader("X-OneAPI-Cache"))
+
 		// 生成缓存键
-		cacheKey := model.GenerateCacheKey(&request)
+		cacheKey := model.GenerateCacheKeyWithExtra(&request, cacheControl.KeyExtra)
 		if cacheKey == "" {
 			c.Next()
 			return
 		}
 
-		// 尝试从缓存获取
-		if cacheItem, found := model.GetLLMCache(cacheKey); found {
-			logger.Infof(c.Request.Context(), "LLM cache hit: %s", cacheKey)
+		if directive != cacheControlNoStore && directive != cacheControlBypass && directive != cacheControlRefresh {
+			if serveFromCache(c, cacheKey, &request, forwardBody, cacheControl) {
+				return
+			}
+		}
 
-			// 返回缓存的响应
-			c.JSON(http.StatusOK, cacheItem.Response)
+		if directive == cacheControlOnlyIfCached {
+			c.JSON(http.StatusGatewayTimeout, gin.H{
+				"success": false,
+				"message": "cache miss and only-if-cached was set",
+			})
 			c.Abort()
 			return
 		}
@@ -59,7 +100,32 @@ func LLMCacheMiddleware() gin.HandlerFunc {
 		// 缓存未命中，继续处理请求
 		logger.Debugf(c.Request.Context(), "LLM cache miss: %s", cacheKey)
 
-		// 创建响应写入器来捕获响应
+		if directive == cacheControlNoStore {
+			c.Next()
+			return
+		}
+
+		// 请求合并：同一cacheKey只放行一个并发请求真正回源，其余请求排队等待
+		// 它写入缓存后直接复用结果，避免同一个prompt被并发重复地转发到上游。
+		if directive != cacheControlBypass && directive != cacheControlRefresh && model.LLMCacheCoalesceEnabled {
+			waitCh, isLeader, release := model.AcquireInFlight(cacheKey)
+			if isLeader {
+				// release必须在刚成为leader时立即defer，而不是等c.Next()返回后再注册，
+				// 否则c.Next()内部（真正的回源调用）一旦panic，这个in-flight槽位
+				// 就永远不会被释放，后续同一cacheKey的所有请求都要等满
+				// LLMCacheCoalesceTimeoutSec才会超时改为自行回源。
+				defer release()
+			} else {
+				timedOut := model.WaitInFlight(waitCh)
+				if !timedOut && tryServeCoalesced(c, cacheKey, request.Stream) {
+					return
+				}
+				logger.Debugf(c.Request.Context(), "coalesce wait finished without a usable cache entry, falling back to own upstream call: %s", cacheKey)
+			}
+		}
+
+		// 创建响应写入器来捕获响应；流式请求下每次Write调用对应一个SSE帧，
+		// frames/frameTimes记录下来用于重放和计算帧间延迟
 		responseWriter := &responseCaptureWriter{
 			ResponseWriter: c.Writer,
 			body:           &bytes.Buffer{},
@@ -70,9 +136,199 @@ func LLMCacheMiddleware() gin.HandlerFunc {
 
 		// 处理响应
 		if responseWriter.statusCode == http.StatusOK {
-			handleCacheResponse(c, cacheKey, &request, responseWriter.body.Bytes())
+			if request.Stream {
+				handleStreamCacheResponse(c, cacheKey, &request, responseWriter.frames, responseWriter.frameTimes, cacheControl)
+			} else {
+				handleCacheResponse(c, cacheKey, &request, responseWriter.body.Bytes(), cacheControl)
+			}
+		}
+	}
+}
+
+// tryServeCoalesced在等待到同一cacheKey的in-flight请求完成后，尝试直接命中它
+// 刚写入的精确缓存项；响应会被标记为coalesced而不是hit/stale，便于观察合并效果。
+// 只查精确哈希而不查语义索引，因为这里关心的是"同一个key的结果是否已经出炉"。
+// isStream必须与当前请求的request.Stream一致：流式请求命中的缓存项没有
+// StreamFrames时视为未命中，交由调用方回源；非流式请求总是返回缓存项的Response。
+func tryServeCoalesced(c *gin.Context, cacheKey string, isStream bool) bool {
+	cacheItem, found := model.GetLLMCache(cacheKey)
+	if !found {
+		return false
+	}
+
+	if isStream && len(cacheItem.StreamFrames) == 0 {
+		return false
+	}
+
+	if isStream && len(cacheItem.StreamFrames) > 0 {
+		replayStreamFrames(c, cacheItem, "coalesced")
+	} else {
+		c.Header("X-OneAPI-Cache", "coalesced")
+		c.JSON(http.StatusOK, model.CloneLLMCacheItemResponse(cacheItem))
+		c.Abort()
+	}
+	return true
+}
+
+// serveFromCache 尝试从精确哈希或语义索引命中缓存并写回响应。命中stale窗口内的
+// 过期缓存项时，立即返回旧响应并在后台触发一次刷新。返回true表示已处理完响应。
+func serveFromCache(c *gin.Context, cacheKey string, request *relaymodel.GeneralOpenAIRequest, forwardBody []byte, cacheControl cacheControlExtension) bool {
+	cacheItem, found := model.GetLLMCache(cacheKey)
+	matchType := "exact"
+	if !found {
+		cacheItem, found = model.GetLLMCacheSemantic(request)
+		matchType = "semantic"
+	}
+	if !found {
+		return false
+	}
+
+	// 语义索引（chunk0-1）完全不区分stream/非stream的prompt，命中的缓存项有
+	// 可能是用一次非流式调用缓存下来的，没有StreamFrames可回放。这种情况下
+	// 不能退化成给期望SSE帧的客户端返回一份JSON，而是应当当作未命中处理，
+	// 让调用方照常发起一次真正的流式回源请求。
+	hasStreamFrames := len(cacheItem.StreamFrames) > 0
+	if request.Stream && !hasStreamFrames {
+		return false
+	}
+
+	status := "hit"
+	stale := model.IsLLMCacheItemStale(cacheItem)
+	if stale {
+		status = "stale"
+	}
+	logger.Infof(c.Request.Context(), "LLM cache %s (%s): %s", status, matchType, cacheKey)
+
+	if request.Stream && hasStreamFrames {
+		replayStreamFrames(c, cacheItem, status)
+	} else {
+		c.Header("X-OneAPI-Cache", status)
+		c.JSON(http.StatusOK, cacheItem.Response)
+		c.Abort()
+	}
+
+	if stale {
+		go refreshStaleCache(c.Copy(), cacheKey, forwardBody, cacheControl)
+	}
+	return true
+}
+
+// replayStreamFrames把缓存项中保存的原始SSE帧序列按LLMCacheStreamReplayPacing
+// 指定的节奏回放给客户端；instant模式下尽快写完所有帧，recorded模式下按
+// FrameDelaysMs还原录制时的帧间隔（并裁剪到LLMCacheStreamMaxFrameDelayMs以内）。
+func replayStreamFrames(c *gin.Context, item *model.LLMCacheItem, status string) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-OneAPI-Cache", status)
+	c.Status(http.StatusOK)
+
+	flusher, canFlush := c.Writer.(http.Flusher)
+
+	for i, frame := range item.StreamFrames {
+		if i > 0 && model.LLMCacheStreamReplayPacing == model.LLMCacheStreamPacingRecorded && i < len(item.FrameDelaysMs) {
+			if delay := item.FrameDelaysMs[i]; delay > 0 {
+				time.Sleep(time.Duration(delay) * time.Millisecond)
+			}
 		}
+		_, _ = c.Writer.Write([]byte(frame))
+		if canFlush {
+			flusher.Flush()
+		}
+	}
+
+	c.Abort()
+}
+
+// staleRefreshTimeout 后台刷新请求的超时时间，避免一次卡住的上游调用让
+// 这个goroutine无限期挂着
+const staleRefreshTimeout = 30 * time.Second
+
+// refreshStaleCache 为stale-while-revalidate发起一次后台回源请求，复用原始的请求体
+// 和鉴权头，并带上refresh指令避免再次命中同一个stale条目，从而刷新缓存。
+// 这里特意不用c.Request.Context()：c是通过c.Copy()传入的，但Copy()仍然共享同一个
+// *http.Request指针，c.Request.Context()拿到的还是原始请求的context——处理该请求
+// 的handler链一返回（也就是调用方c.Abort()之后几乎立刻），net/http就会取消这个
+// context，导致这里的回源调用还没发出去就已经"context canceled"，stale-while-
+// revalidate也就退化成了只返回旧值、永远刷新不了。所以必须用一个独立的、带自己
+// 超时的context。
+func refreshStaleCache(c *gin.Context, cacheKey string, forwardBody []byte, cacheControl cacheControlExtension) {
+	ctx, cancel := context.WithTimeout(context.Background(), staleRefreshTimeout)
+	defer cancel()
+
+	refreshURL := *c.Request.URL
+	if c.Request.URL.Scheme == "" {
+		refreshURL.Scheme = "http"
+		refreshURL.Host = c.Request.Host
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, refreshURL.String(), bytes.NewReader(forwardBody))
+	if err != nil {
+		logger.Errorf(ctx, "failed to build stale-revalidate request: %s", err.Error())
+		return
+	}
+	req.Header = c.Request.Header.Clone()
+	req.Header.Set("X-OneAPI-Cache", cacheControlRefresh)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		logger.Errorf(ctx, "stale-while-revalidate refresh failed for %s: %s", cacheKey, err.Error())
+		return
+	}
+	defer resp.Body.Close()
+
+	logger.Debugf(ctx, "stale-while-revalidate refresh completed for %s, status=%d", cacheKey, resp.StatusCode)
+}
+
+// shouldExcludeFromCache 判断请求是否默认不应被缓存：工具调用、函数调用以及
+// json_schema格式的响应通常依赖上游的实时/个性化行为，默认排除在缓存之外。
+func shouldExcludeFromCache(request *relaymodel.GeneralOpenAIRequest) bool {
+	if model.GetLLMCacheConfig().AllowToolCalls {
+		return false
+	}
+
+	if len(request.Tools) > 0 {
+		return true
+	}
+	if choice, ok := request.ToolChoice.(string); request.ToolChoice != nil && (!ok || choice != "none") {
+		return true
+	}
+	if len(request.Functions) > 0 {
+		return true
+	}
+	if request.ResponseFormat != nil && request.ResponseFormat.Type == "json_schema" {
+		return true
+	}
+
+	return false
+}
+
+// extractCacheControl 从原始请求体中剥离cache_control扩展字段，返回转发给上游的
+// 请求体（已移除该字段）以及解析出的扩展内容。请求体中不包含该字段时原样返回。
+func extractCacheControl(rawBody []byte) ([]byte, cacheControlExtension) {
+	var cacheControl cacheControlExtension
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(rawBody, &fields); err != nil {
+		return rawBody, cacheControl
+	}
+
+	raw, exists := fields["cache_control"]
+	if !exists {
+		return rawBody, cacheControl
+	}
+
+	if err := json.Unmarshal(raw, &cacheControl); err != nil {
+		logger.Errorf(context.Background(), "failed to unmarshal cache_control: %s", err.Error())
+	}
+
+	delete(fields, "cache_control")
+	forwardBody, err := json.Marshal(fields)
+	if err != nil {
+		return rawBody, cacheControl
 	}
+
+	return forwardBody, cacheControl
 }
 
 // isCacheableRequest 判断是否是可缓存的请求
@@ -87,7 +343,7 @@ func isCacheableRequest(c *gin.Context) bool {
 		return false
 	}
 
-	// 检查请求头，跳过流式请求
+	// 流式与非流式请求都走到这里，具体是否缓存流式响应由LLMCacheStreamEnabled决定
 	contentType := c.GetHeader("Content-Type")
 	if !strings.Contains(contentType, "application/json") {
 		return false
@@ -97,7 +353,7 @@ func isCacheableRequest(c *gin.Context) bool {
 }
 
 // handleCacheResponse 处理响应并缓存
-func handleCacheResponse(c *gin.Context, cacheKey string, request *relaymodel.GeneralOpenAIRequest, responseBody []byte) {
+func handleCacheResponse(c *gin.Context, cacheKey string, request *relaymodel.GeneralOpenAIRequest, responseBody []byte, cacheControl cacheControlExtension) {
 	// 解析响应
 	var response relaymodel.TextResponse
 	if err := json.Unmarshal(responseBody, &response); err != nil {
@@ -111,11 +367,57 @@ func handleCacheResponse(c *gin.Context, cacheKey string, request *relaymodel.Ge
 		return
 	}
 
-	// 设置缓存
-	model.SetLLMCache(cacheKey, &response, &response.Usage, request)
+	userID, channelID, group := cacheTagsFromContext(c, cacheControl)
+	model.SetLLMCacheWithTags(cacheKey, &response, &response.Usage, request, userID, channelID, group, cacheControl.TTL)
 	logger.Infof(c.Request.Context(), "LLM cache set: %s", cacheKey)
 }
 
+// cacheTagsFromContext解析用于DeleteByTag的用户/渠道/分组标签，默认取自gin上下文，
+// cache_control.tags可以覆盖其中的user_id/group（channel_id始终来自上下文，不允许客户端伪造）
+func cacheTagsFromContext(c *gin.Context, cacheControl cacheControlExtension) (userID string, channelID int, group string) {
+	userID = c.GetString("username")
+	channelID = c.GetInt("channel_id")
+	group = c.GetString("group")
+	if cacheControl.Tags != nil {
+		if v, ok := cacheControl.Tags[model.LLMCacheTagUserID]; ok {
+			userID = v
+		}
+		if v, ok := cacheControl.Tags[model.LLMCacheTagGroup]; ok {
+			group = v
+		}
+	}
+	return userID, channelID, group
+}
+
+// handleStreamCacheResponse 把捕获到的原始SSE帧序列重新拼装成一个等价的非流式
+// 响应，复用与非流式响应相同的长度/敏感词校验，校验通过后连同原始帧一起写入缓存。
+// 拼装失败（帧序列不完整、或中途出现了error chunk）时直接放弃缓存本次响应。
+func handleStreamCacheResponse(c *gin.Context, cacheKey string, request *relaymodel.GeneralOpenAIRequest, frames []string, frameTimes []time.Time, cacheControl cacheControlExtension) {
+	response, usage, ok := model.AssembleStreamResponse(frames)
+	if !ok {
+		logger.Debugf(c.Request.Context(), "stream response incomplete or errored, skipping cache: %s", cacheKey)
+		return
+	}
+
+	if !shouldCache(response) {
+		logger.Debugf(c.Request.Context(), "stream response not cacheable: %s", cacheKey)
+		return
+	}
+
+	frameDelaysMs := make([]int64, len(frameTimes))
+	for i := 1; i < len(frameTimes); i++ {
+		delay := frameTimes[i].Sub(frameTimes[i-1]).Milliseconds()
+		if delay > model.LLMCacheStreamMaxFrameDelayMs {
+			delay = model.LLMCacheStreamMaxFrameDelayMs
+		}
+		frameDelaysMs[i] = delay
+	}
+
+	userID, channelID, group := cacheTagsFromContext(c, cacheControl)
+	model.SetLLMCacheStreamWithTags(cacheKey, frames, frameDelaysMs, response, usage, request, userID, channelID, group, cacheControl.TTL)
+	logger.Infof(c.Request.Context(), "LLM stream cache set: %s, frames=%d", cacheKey, len(frames))
+}
+
 // shouldCache 判断是否应该缓存
 func shouldCache(response *relaymodel.TextResponse) bool {
 	// 检查响应长度
@@ -139,20 +441,29 @@ func shouldCache(response *relaymodel.TextResponse) bool {
 	return true
 }
 
-// responseCaptureWriter 响应捕获写入器
+// responseCaptureWriter 响应捕获写入器。非流式响应只使用body；流式响应下游
+// 每次Write通常对应上游flush出的一个完整SSE帧，因此额外按调用粒度记录下
+// frames/frameTimes，用于重放以及计算录制时的帧间隔。
 type responseCaptureWriter struct {
 	gin.ResponseWriter
 	body       *bytes.Buffer
 	statusCode int
+
+	frames     []string
+	frameTimes []time.Time
 }
 
 func (w *responseCaptureWriter) Write(b []byte) (int, error) {
 	w.body.Write(b)
+	w.frames = append(w.frames, string(b))
+	w.frameTimes = append(w.frameTimes, time.Now())
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *responseCaptureWriter) WriteString(s string) (int, error) {
 	w.body.WriteString(s)
+	w.frames = append(w.frames, s)
+	w.frameTimes = append(w.frameTimes, time.Now())
 	return w.ResponseWriter.WriteString(s)
 }
 
@@ -179,6 +490,55 @@ func LLMCacheStatsMiddleware() gin.HandlerFunc {
 	}
 }
 
+// LLMCacheSemanticStatsMiddleware 语义缓存统计中间件
+func LLMCacheSemanticStatsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 只处理语义统计请求
+		if c.Request.URL.Path != "/api/llm_cache/semantic_stats" {
+			c.Next()
+			return
+		}
+
+		stats := model.GetLLMCacheSemanticStats()
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    stats,
+		})
+		c.Abort()
+	}
+}
+
+// LLMCacheDeleteByTagMiddleware 按标签批量失效缓存中间件
+func LLMCacheDeleteByTagMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// 只处理按标签删除请求
+		if c.Request.URL.Path != "/api/llm_cache/delete_by_tag" || c.Request.Method != http.MethodPost {
+			c.Next()
+			return
+		}
+
+		var req struct {
+			Tag   string `json:"tag"`
+			Value string `json:"value"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || req.Tag == "" {
+			c.JSON(http.StatusBadRequest, gin.H{
+				"success": false,
+				"message": "无效的标签参数",
+			})
+			c.Abort()
+			return
+		}
+
+		deleted := model.DeleteByTag(req.Tag, req.Value)
+		c.JSON(http.StatusOK, gin.H{
+			"success": true,
+			"data":    gin.H{"deleted": deleted},
+		})
+		c.Abort()
+	}
+}
+
 // LLMCacheClearMiddleware 清空缓存中间件
 func LLMCacheClearMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
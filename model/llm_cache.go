@@ -1,14 +1,18 @@
 package model
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
 	"sync"
 	"time"
 
-	"github.com/songquanpeng/one-api/common"
 	"github.com/songquanpeng/one-api/common/logger"
 	relaymodel "github.com/songquanpeng/one-api/relay/model"
 )
@@ -21,6 +25,31 @@ var (
 	LLMCacheMinResponseLength   = 10
 	LLMCacheMaxResponseLength   = 10000
 	LLMCacheSimilarityThreshold = 0.95
+
+	// 语义缓存配置变量。启用后，精确哈希未命中的请求会在缓存路径上同步发起一次
+	// 到/v1/embeddings的HTTP调用（见GetLLMCacheSemantic/buildCacheItem），给请求
+	// 增加一次完整的网络往返延迟；如果这个延迟对业务不可接受，应保持
+	// LLMCacheSemanticEnabled=false。
+	LLMCacheSemanticEnabled   = false
+	LLMCacheEmbeddingModel    = "text-embedding-ada-002"
+	LLMCacheEmbeddingPerModel = true // 按model隔离语义索引，避免跨模型误命中
+	// LLMCacheEmbeddingDimension必须与LLMCacheEmbeddingModel实际输出的向量维度一致
+	// （text-embedding-ada-002/text-embedding-3-small等均为1536）。LSH索引的超平面
+	// 在newSemanticIndex时就已按这个维度固定下来，如果运营方把LLMCacheEmbeddingModel
+	// 换成了一个输出维度不同的模型却忘了同步改这里，GetLLMCacheSemantic/
+	// buildCacheItem会在校验维度时拒绝该向量，而不是让hashVector截断点积、
+	// 静默产出没有意义的分桶结果。
+	LLMCacheEmbeddingDimension    = 1536
+	LLMCacheSemanticMaxCandidates = 64 // 单次查找最多重新计算相似度的候选数量
+	LLMCacheLSHTables             = 8
+	LLMCacheLSHBits               = 16
+
+	// LLMCacheBackendType 选择缓存后端：memory / redis / two_tier
+	LLMCacheBackendType = LLMCacheBackendMemory
+
+	// LLMCacheStaleWindow stale-while-revalidate窗口（秒）：缓存项过期后的这段时间内
+	// 仍可直接返回给客户端，同时触发一次后台刷新。0表示关闭SWR，过期即视为未命中。
+	LLMCacheStaleWindow int64 = 0
 )
 
 // LLMCacheItem 缓存项结构
@@ -34,6 +63,96 @@ type LLMCacheItem struct {
 	HitCount      int64                    `json:"hit_count"`
 	LastAccessed  int64                    `json:"last_accessed"`
 	RequestParams map[string]interface{}   `json:"request_params"`
+	Embedding     []float32                `json:"embedding,omitempty"` // 请求语义向量，用于近似语义命中
+
+	// 标签元数据，用于DeleteByTag按维度批量失效
+	UserID    string `json:"user_id,omitempty"`
+	ChannelID int    `json:"channel_id,omitempty"`
+	Group     string `json:"group,omitempty"`
+
+	// StreamFrames/FrameDelaysMs仅在该缓存项来自一次stream=true的请求时有值，
+	// 保存原始SSE帧序列（含"data: ..."前缀与帧间分隔）以便原样回放给客户端；
+	// FrameDelaysMs与StreamFrames等长，记录录制时相邻帧之间的间隔（毫秒）
+	StreamFrames  []string `json:"stream_frames,omitempty"`
+	FrameDelaysMs []int64  `json:"frame_delays_ms,omitempty"`
+}
+
+// LLMCacheSemanticStats 语义缓存命中统计
+type LLMCacheSemanticStats struct {
+	ExactHits    int64 `json:"exact_hits"`
+	SemanticHits int64 `json:"semantic_hits"`
+	Misses       int64 `json:"misses"`
+}
+
+// EmbeddingProvider 生成文本向量的抽象接口，便于替换不同的embedding来源
+type EmbeddingProvider interface {
+	GetEmbedding(ctx context.Context, text string) ([]float32, error)
+}
+
+// openAIEmbeddingProvider 通过OpenAI兼容的/v1/embeddings接口获取向量
+type openAIEmbeddingProvider struct {
+	baseURL    string
+	apiKey     string
+	model      string
+	httpClient *http.Client
+}
+
+// NewOpenAIEmbeddingProvider 创建一个调用OpenAI兼容渠道的embedding provider。
+// baseURL应指向具体渠道的API地址（例如某个已配置channel的BaseURL）。
+func NewOpenAIEmbeddingProvider(baseURL, apiKey, model string) EmbeddingProvider {
+	return &openAIEmbeddingProvider{
+		baseURL:    strings.TrimRight(baseURL, "/"),
+		apiKey:     apiKey,
+		model:      model,
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+type embeddingRequest struct {
+	Model string `json:"model"`
+	Input string `json:"input"`
+}
+
+type embeddingResponse struct {
+	Data []struct {
+		Embedding []float32 `json:"embedding"`
+	} `json:"data"`
+}
+
+func (p *openAIEmbeddingProvider) GetEmbedding(ctx context.Context, text string) ([]float32, error) {
+	reqBody, err := json.Marshal(embeddingRequest{Model: p.model, Input: text})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.baseURL+"/v1/embeddings", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+p.apiKey)
+	}
+
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("embedding request failed with status %d", resp.StatusCode)
+	}
+
+	var parsed embeddingResponse
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return nil, err
+	}
+	if len(parsed.Data) == 0 {
+		return nil, fmt.Errorf("embedding response contains no data")
+	}
+
+	return parsed.Data[0].Embedding, nil
 }
 
 // LLMCacheStats 缓存统计
@@ -44,6 +163,17 @@ type LLMCacheStats struct {
 	Evictions  int64 `json:"evictions"`
 	TotalSize  int64 `json:"total_size"`
 	MaxSize    int64 `json:"max_size"`
+
+	// EstimatedHitRate/AdmissionRate仅在使用tinylfu淘汰策略时有意义，
+	// 由TinyLFU引擎的命中/准入计数按分片取平均得出，用于观察准入策略的效果；其他策略下恒为0。
+	EstimatedHitRate float64 `json:"estimated_hit_rate,omitempty"`
+	AdmissionRate    float64 `json:"admission_rate,omitempty"`
+
+	// InFlight是遇到过同一cacheKey已有请求在回源、从而排队等待的请求数，
+	// CoalescedHits是其中在超时前等到负责回源的请求结束的数量（不论之后是否
+	// 命中了可用的缓存项）
+	InFlight      int64 `json:"in_flight"`
+	CoalescedHits int64 `json:"coalesced_hits"`
 }
 
 // LLMCacheConfig 缓存配置
@@ -54,12 +184,11 @@ type LLMCacheConfig struct {
 	MinResponseLength   int     `json:"min_response_length"`
 	MaxResponseLength   int     `json:"max_response_length"`
 	SimilarityThreshold float64 `json:"similarity_threshold"`
+	StaleWindow         int64   `json:"stale_window"`     // 过期后仍可作为stale响应返回的秒数，0表示不开启SWR
+	AllowToolCalls      bool    `json:"allow_tool_calls"` // 管理员覆盖：允许缓存携带tools/functions/json_schema的请求
 }
 
 var (
-	llmCache       = make(map[string]*LLMCacheItem)
-	llmCacheMutex  sync.RWMutex
-	llmCacheStats  = &LLMCacheStats{}
 	llmCacheConfig = LLMCacheConfig{
 		Enabled:             false, // 默认禁用，通过InitLLMCache设置
 		TTL:                 3600,  // 1小时
@@ -68,8 +197,202 @@ var (
 		MaxResponseLength:   10000,
 		SimilarityThreshold: 0.95,
 	}
+	llmCacheConfigMutex sync.RWMutex
+
+	// llmCacheBackend 实际存储缓存项的后端，默认在InitLLMCache中按LLMCacheBackendType创建
+	llmCacheBackend LLMCacheBackend = newMemoryBackend()
+
+	llmEmbeddingProvider  EmbeddingProvider
+	llmSemanticIndex      *SemanticIndex
+	llmSemanticStats      = &LLMCacheSemanticStats{}
+	llmSemanticStatsMutex sync.RWMutex
 )
 
+// pruneSemanticIndex 把key从语义索引中移除，供缓存项离开存储层的各个路径
+// （过期清理、容量淘汰、手动删除）统一调用，避免llmSemanticIndex随着条目
+// 的自然淘汰无限增长而不回收
+func pruneSemanticIndex(key string) {
+	if llmSemanticIndex != nil {
+		llmSemanticIndex.Remove(key)
+	}
+}
+
+// SemanticIndex 基于局部敏感哈希(LSH)的语义向量索引，使K个随机超平面的符号位
+// 将向量分桶，使查找时只需重新扫描落在同一个桶里的候选向量，避免全量遍历。
+type SemanticIndex struct {
+	mu      sync.RWMutex
+	tables  int
+	bits    int
+	dim     int                   // 构建索引时固定下来的向量维度，所有写入/查询的向量都必须与之匹配
+	planes  [][][]float32         // tables x bits 个随机超平面
+	buckets []map[string][]string // tables 个 bucket -> keys
+	vectors map[string][]float32  // key -> 原始向量（单位化后）
+	modelOf map[string]string     // key -> 所属model，用于按model隔离
+}
+
+// newSemanticIndex 创建一个拥有tables张哈希表、每张表bits位的LSH索引，
+// 每张表的超平面按dim维构造，之后所有写入/查询的向量都必须是这个维度。
+func newSemanticIndex(tables, bits, dim int) *SemanticIndex {
+	idx := &SemanticIndex{
+		tables:  tables,
+		bits:    bits,
+		dim:     dim,
+		vectors: make(map[string][]float32),
+		modelOf: make(map[string]string),
+	}
+	idx.buckets = make([]map[string][]string, tables)
+	idx.planes = make([][][]float32, tables)
+	for t := 0; t < tables; t++ {
+		idx.buckets[t] = make(map[string][]string)
+		idx.planes[t] = make([][]float32, bits)
+		for b := 0; b < bits; b++ {
+			plane := make([]float32, dim)
+			for d := 0; d < dim; d++ {
+				plane[d] = float32(rand.NormFloat64())
+			}
+			idx.planes[t][b] = plane
+		}
+	}
+	return idx
+}
+
+// Dimension 返回该索引构建时固定下来的向量维度，调用方应在Add/Search之前
+// 校验传入向量的维度与之一致，而不是依赖hashVector截断点积静默兼容。
+func (idx *SemanticIndex) Dimension() int {
+	return idx.dim
+}
+
+// hashVector 计算向量在第table张表上的符号位桶标签
+func (idx *SemanticIndex) hashVector(table int, vec []float32) string {
+	bits := make([]byte, idx.bits)
+	for b := 0; b < idx.bits; b++ {
+		plane := idx.planes[table][b]
+		var dot float32
+		for d := 0; d < len(vec) && d < len(plane); d++ {
+			dot += vec[d] * plane[d]
+		}
+		if dot >= 0 {
+			bits[b] = '1'
+		} else {
+			bits[b] = '0'
+		}
+	}
+	return string(bits)
+}
+
+// Add 将key对应的向量加入索引，vec需已经单位化
+func (idx *SemanticIndex) Add(key string, vec []float32, model string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	idx.vectors[key] = vec
+	idx.modelOf[key] = model
+	for t := 0; t < idx.tables; t++ {
+		bucket := idx.hashVector(t, vec)
+		idx.buckets[t][bucket] = append(idx.buckets[t][bucket], key)
+	}
+}
+
+// Remove 从索引中移除key
+func (idx *SemanticIndex) Remove(key string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	vec, exists := idx.vectors[key]
+	if !exists {
+		return
+	}
+	for t := 0; t < idx.tables; t++ {
+		bucket := idx.hashVector(t, vec)
+		keys := idx.buckets[t][bucket]
+		for i, k := range keys {
+			if k == key {
+				idx.buckets[t][bucket] = append(keys[:i], keys[i+1:]...)
+				break
+			}
+		}
+	}
+	delete(idx.vectors, key)
+	delete(idx.modelOf, key)
+}
+
+// Search 返回与vec命中同一个LSH桶的候选key集合（已去重，并按model过滤），
+// 最多返回maxCandidates个，交由调用方重新计算余弦相似度做精确比较。
+func (idx *SemanticIndex) Search(vec []float32, model string, maxCandidates int) []string {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	candidates := make([]string, 0, maxCandidates)
+	for t := 0; t < idx.tables; t++ {
+		bucket := idx.hashVector(t, vec)
+		for _, key := range idx.buckets[t][bucket] {
+			if seen[key] {
+				continue
+			}
+			if LLMCacheEmbeddingPerModel && idx.modelOf[key] != model {
+				continue
+			}
+			seen[key] = true
+			candidates = append(candidates, key)
+			if len(candidates) >= maxCandidates {
+				return candidates
+			}
+		}
+	}
+	return candidates
+}
+
+// cosineSimilarity 计算两个向量的余弦相似度
+func cosineSimilarity(a, b []float32) float64 {
+	var dot, normA, normB float64
+	for i := 0; i < len(a) && i < len(b); i++ {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return dot / (math.Sqrt(normA) * math.Sqrt(normB))
+}
+
+// normalizeVector 返回vec的单位向量，避免在余弦相似度计算中重复开方
+func normalizeVector(vec []float32) []float32 {
+	var norm float64
+	for _, v := range vec {
+		norm += float64(v) * float64(v)
+	}
+	norm = math.Sqrt(norm)
+	if norm == 0 {
+		return vec
+	}
+	out := make([]float32, len(vec))
+	for i, v := range vec {
+		out[i] = float32(float64(v) / norm)
+	}
+	return out
+}
+
+// SetEmbeddingProvider 配置语义缓存使用的embedding provider，通常由调用方
+// 在启动时注入一个基于已配置渠道的OpenAI兼容实现。
+func SetEmbeddingProvider(provider EmbeddingProvider) {
+	llmEmbeddingProvider = provider
+}
+
+// extractPromptText 拼接请求中所有user角色消息的文本内容，用作embedding输入
+func extractPromptText(request *relaymodel.GeneralOpenAIRequest) string {
+	var sb strings.Builder
+	for _, msg := range request.Messages {
+		if msg.Role != "user" {
+			continue
+		}
+		sb.WriteString(msg.StringContent())
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
 // InitLLMCache 初始化LLM缓存
 func InitLLMCache() {
 	if !LLMCacheEnabled {
@@ -77,10 +400,18 @@ func InitLLMCache() {
 		return
 	}
 
+	llmCacheBackend = newLLMCacheBackend(LLMCacheBackendType)
+
 	logger.SysLog("LLM cache initialized")
-	logger.SysLog(fmt.Sprintf("LLM cache config: TTL=%d, MaxSize=%d, MinLength=%d, MaxLength=%d, Threshold=%.2f",
+	logger.SysLog(fmt.Sprintf("LLM cache config: TTL=%d, MaxSize=%d, MinLength=%d, MaxLength=%d, Threshold=%.2f, Backend=%s",
 		LLMCacheTTL, LLMCacheMaxSize, LLMCacheMinResponseLength,
-		LLMCacheMaxResponseLength, LLMCacheSimilarityThreshold))
+		LLMCacheMaxResponseLength, LLMCacheSimilarityThreshold, LLMCacheBackendType))
+
+	if LLMCacheSemanticEnabled {
+		llmSemanticIndex = newSemanticIndex(LLMCacheLSHTables, LLMCacheLSHBits, LLMCacheEmbeddingDimension)
+		logger.SysLog(fmt.Sprintf("LLM semantic cache enabled: model=%s, dimension=%d, tables=%d, bits=%d, maxCandidates=%d",
+			LLMCacheEmbeddingModel, LLMCacheEmbeddingDimension, LLMCacheLSHTables, LLMCacheLSHBits, LLMCacheSemanticMaxCandidates))
+	}
 
 	// 启动清理过期缓存的goroutine
 	go cleanExpiredCache()
@@ -88,6 +419,12 @@ func InitLLMCache() {
 
 // GenerateCacheKey 生成缓存键
 func GenerateCacheKey(request *relaymodel.GeneralOpenAIRequest) string {
+	return GenerateCacheKeyWithExtra(request, "")
+}
+
+// GenerateCacheKeyWithExtra 生成缓存键，keyExtra来自请求体中的cache_control.key_extra，
+// 用于让调用方在相同请求参数下人为区分缓存条目（例如按租户隔离）
+func GenerateCacheKeyWithExtra(request *relaymodel.GeneralOpenAIRequest, keyExtra string) string {
 	// 创建用于哈希的数据结构
 	cacheData := map[string]interface{}{
 		"model":             request.Model,
@@ -99,6 +436,9 @@ func GenerateCacheKey(request *relaymodel.GeneralOpenAIRequest) string {
 		"presence_penalty":  request.PresencePenalty,
 		"stream":            request.Stream,
 	}
+	if keyExtra != "" {
+		cacheData["key_extra"] = keyExtra
+	}
 
 	// 序列化为JSON
 	jsonData, err := json.Marshal(cacheData)
@@ -112,6 +452,12 @@ func GenerateCacheKey(request *relaymodel.GeneralOpenAIRequest) string {
 	return fmt.Sprintf("llm_cache:%x", hash)
 }
 
+// IsLLMCacheItemStale 判断缓存项是否已过ExpiresAt，供中间件决定是否需要一边返回
+// 旧响应一边触发后台刷新。它不检查stale窗口的上界：超出窗口的项在后端Get时已按未命中处理。
+func IsLLMCacheItemStale(item *LLMCacheItem) bool {
+	return time.Now().Unix() > item.ExpiresAt
+}
+
 // GetLLMCache 获取缓存项
 func GetLLMCache(key string) (*LLMCacheItem, bool) {
 	if !LLMCacheEnabled {
@@ -120,42 +466,142 @@ func GetLLMCache(key string) (*LLMCacheItem, bool) {
 
 	logger.Infof(context.Background(), "GetLLMCache called, key=%s, enabled=%v", key, LLMCacheEnabled)
 
-	llmCacheMutex.RLock()
-	defer llmCacheMutex.RUnlock()
+	item, found := llmCacheBackend.Get(key)
+	if !found {
+		return nil, false
+	}
+
+	logger.Infof(context.Background(), "LLM cache hit: %s", key)
+
+	llmSemanticStatsMutex.Lock()
+	llmSemanticStats.ExactHits++
+	llmSemanticStatsMutex.Unlock()
 
-	item, exists := llmCache[key]
-	if !exists {
-		llmCacheStats.Misses++
+	return item, true
+}
+
+// GetLLMCacheSemantic 在精确哈希未命中时，尝试通过请求的语义向量寻找一个
+// 足够相似的历史缓存项。仅当语义缓存已启用且配置了embedding provider时生效。
+func GetLLMCacheSemantic(request *relaymodel.GeneralOpenAIRequest) (*LLMCacheItem, bool) {
+	if !LLMCacheEnabled || !LLMCacheSemanticEnabled || llmEmbeddingProvider == nil || llmSemanticIndex == nil {
 		return nil, false
 	}
 
-	// 检查是否过期
-	if time.Now().Unix() > item.ExpiresAt {
-		llmCacheMutex.RUnlock()
-		llmCacheMutex.Lock()
-		delete(llmCache, key)
-		llmCacheStats.TotalItems--
-		llmCacheMutex.Unlock()
-		llmCacheMutex.RLock()
-		llmCacheStats.Misses++
+	promptText := extractPromptText(request)
+	if promptText == "" {
 		return nil, false
 	}
 
-	// 更新访问统计
-	item.HitCount++
-	item.LastAccessed = time.Now().Unix()
-	llmCacheStats.Hits++
+	ctx := context.Background()
+	rawVec, err := llmEmbeddingProvider.GetEmbedding(ctx, promptText)
+	if err != nil {
+		logger.Errorf(ctx, "failed to get embedding for semantic cache lookup: %s", err.Error())
+		return nil, false
+	}
+	if len(rawVec) != llmSemanticIndex.Dimension() {
+		// LLMCacheEmbeddingModel换成了一个输出维度不同的模型但没有同步更新
+		// LLMCacheEmbeddingDimension，LSH索引的超平面还是按旧维度构造的。
+		// 与其让hashVector截断点积算出没有意义的分桶，不如直接拒绝这次查找。
+		logger.Errorf(ctx, "embedding dimension mismatch: got %d, index expects %d, skipping semantic cache lookup",
+			len(rawVec), llmSemanticIndex.Dimension())
+		return nil, false
+	}
+	vec := normalizeVector(rawVec)
+
+	// 只按candidateKeys逐个Get，而不是Iterate扫描整个后端：llmSemanticIndex.Search
+	// 已经把候选集收窄到与查询向量共享LSH桶的那一小撮key，这里再做全量扫描就
+	// 把Search换来的次线性查找退化回了O(n)
+	candidateKeys := llmSemanticIndex.Search(vec, request.Model, LLMCacheSemanticMaxCandidates)
+
+	var bestItem *LLMCacheItem
+	var bestSimilarity float64
+	for _, key := range candidateKeys {
+		item, found := llmCacheBackend.Get(key)
+		if !found || time.Now().Unix() > item.ExpiresAt || len(item.Embedding) == 0 {
+			continue
+		}
+		similarity := cosineSimilarity(vec, item.Embedding)
+		if similarity > bestSimilarity {
+			bestSimilarity = similarity
+			bestItem = item
+		}
+	}
 
-	logger.Infof(context.Background(), "LLM cache hit: %s", key)
+	if bestItem == nil || bestSimilarity < LLMCacheSimilarityThreshold {
+		llmSemanticStatsMutex.Lock()
+		llmSemanticStats.Misses++
+		llmSemanticStatsMutex.Unlock()
+		return nil, false
+	}
 
-	return item, true
+	// HitCount/LastAccessed已由llmCacheBackend.Get在持锁期间更新，这里不再重复写入
+	llmSemanticStatsMutex.Lock()
+	llmSemanticStats.SemanticHits++
+	llmSemanticStatsMutex.Unlock()
+
+	logger.Infof(ctx, "LLM semantic cache hit: %s (similarity=%.4f)", bestItem.RequestHash, bestSimilarity)
+
+	return bestItem, true
+}
+
+// GetLLMCacheSemanticStats 获取语义缓存命中统计（按精确/语义命中拆分）
+func GetLLMCacheSemanticStats() *LLMCacheSemanticStats {
+	llmSemanticStatsMutex.RLock()
+	defer llmSemanticStatsMutex.RUnlock()
+
+	stats := *llmSemanticStats
+	return &stats
 }
 
 // SetLLMCache 设置缓存项
 func SetLLMCache(key string, response *relaymodel.TextResponse, usage *relaymodel.Usage, request *relaymodel.GeneralOpenAIRequest) {
-	if !LLMCacheEnabled {
+	SetLLMCacheWithTags(key, response, usage, request, "", 0, "", 0)
+}
+
+// SetLLMCacheWithTags 设置缓存项，并附带用于DeleteByTag的标签元数据
+// （用户ID、渠道ID、分组），便于后续按维度批量失效。ttlOverride大于0时覆盖默认的
+// LLMCacheTTL，用于响应请求体中的cache_control.ttl。
+func SetLLMCacheWithTags(key string, response *relaymodel.TextResponse, usage *relaymodel.Usage, request *relaymodel.GeneralOpenAIRequest, userID string, channelID int, group string, ttlOverride int64) {
+	item := buildCacheItem(key, response, usage, request, userID, channelID, group, ttlOverride)
+	if item == nil {
+		return
+	}
+
+	llmCacheBackend.Set(key, item)
+
+	if len(item.Embedding) > 0 {
+		llmSemanticIndex.Add(key, item.Embedding, item.Model)
+	}
+
+	logger.Debugf(context.Background(), "cached LLM response with key: %s", key)
+}
+
+// SetLLMCacheStreamWithTags与SetLLMCacheWithTags类似，但额外保存原始SSE帧序列
+// 及帧间延迟，供后续以流式方式原样回放给客户端；response/usage是从该SSE序列
+// 重新拼装出的等价非流式结果，依旧用于长度校验、语义索引等既有逻辑。
+func SetLLMCacheStreamWithTags(key string, frames []string, frameDelaysMs []int64, response *relaymodel.TextResponse, usage *relaymodel.Usage, request *relaymodel.GeneralOpenAIRequest, userID string, channelID int, group string, ttlOverride int64) {
+	item := buildCacheItem(key, response, usage, request, userID, channelID, group, ttlOverride)
+	if item == nil {
 		return
 	}
+	item.StreamFrames = frames
+	item.FrameDelaysMs = frameDelaysMs
+
+	llmCacheBackend.Set(key, item)
+
+	if len(item.Embedding) > 0 {
+		llmSemanticIndex.Add(key, item.Embedding, item.Model)
+	}
+
+	logger.Debugf(context.Background(), "cached LLM stream response with key: %s, frames=%d", key, len(frames))
+}
+
+// buildCacheItem校验响应是否满足缓存长度要求，计算语义向量并构造出一个待写入
+// 后端的LLMCacheItem；不满足缓存条件时返回nil。
+func buildCacheItem(key string, response *relaymodel.TextResponse, usage *relaymodel.Usage, request *relaymodel.GeneralOpenAIRequest, userID string, channelID int, group string, ttlOverride int64) *LLMCacheItem {
+	if !LLMCacheEnabled {
+		return nil
+	}
 
 	logger.Infof(context.Background(), "SetLLMCache called, key=%s, enabled=%v", key, LLMCacheEnabled)
 
@@ -168,7 +614,12 @@ func SetLLMCache(key string, response *relaymodel.TextResponse, usage *relaymode
 	if len(responseText) < LLMCacheMinResponseLength || len(responseText) > LLMCacheMaxResponseLength {
 		logger.Debugf(context.Background(), "response length %d not in range [%d, %d], skipping cache",
 			len(responseText), LLMCacheMinResponseLength, LLMCacheMaxResponseLength)
-		return
+		return nil
+	}
+
+	ttl := int64(LLMCacheTTL)
+	if ttlOverride > 0 {
+		ttl = ttlOverride
 	}
 
 	now := time.Now().Unix()
@@ -178,10 +629,13 @@ func SetLLMCache(key string, response *relaymodel.TextResponse, usage *relaymode
 		Response:      response,
 		Usage:         usage,
 		CreatedAt:     now,
-		ExpiresAt:     now + int64(LLMCacheTTL),
+		ExpiresAt:     now + ttl,
 		HitCount:      0,
 		LastAccessed:  now,
 		RequestParams: make(map[string]interface{}),
+		UserID:        userID,
+		ChannelID:     channelID,
+		Group:         group,
 	}
 
 	// 存储请求参数（用于调试）
@@ -195,153 +649,108 @@ func SetLLMCache(key string, response *relaymodel.TextResponse, usage *relaymode
 		item.RequestParams["max_tokens"] = request.MaxTokens
 	}
 
-	llmCacheMutex.Lock()
-	defer llmCacheMutex.Unlock()
-
-	// 检查缓存大小限制
-	if len(llmCache) >= LLMCacheMaxSize {
-		// 执行LRU淘汰
-		evictLRU()
-	}
-
-	llmCache[key] = item
-	llmCacheStats.TotalItems++
-
-	// 如果Redis可用，也存储到Redis
-	if common.RedisEnabled {
-		go func() {
-			itemJSON, err := json.Marshal(item)
-			if err == nil {
-				common.RedisSetEx(key, string(itemJSON), int(LLMCacheTTL))
+	// 计算请求的语义向量，用于后续的近似语义命中
+	if LLMCacheSemanticEnabled && llmEmbeddingProvider != nil && llmSemanticIndex != nil {
+		if promptText := extractPromptText(request); promptText != "" {
+			if rawVec, err := llmEmbeddingProvider.GetEmbedding(context.Background(), promptText); err == nil {
+				if len(rawVec) == llmSemanticIndex.Dimension() {
+					item.Embedding = normalizeVector(rawVec)
+				} else {
+					// 维度与索引构建时不一致（LLMCacheEmbeddingModel被换成了输出维度不同
+					// 的模型），不把这个向量写进索引，避免hashVector静默截断点积产出
+					// 没有意义的分桶
+					logger.Errorf(context.Background(), "embedding dimension mismatch: got %d, index expects %d, skipping embedding for key %s",
+						len(rawVec), llmSemanticIndex.Dimension(), key)
+				}
+			} else {
+				logger.Errorf(context.Background(), "failed to get embedding for semantic cache: %s", err.Error())
 			}
-		}()
-	}
-
-	logger.Debugf(context.Background(), "cached LLM response with key: %s", key)
-}
-
-// evictLRU 执行LRU淘汰
-func evictLRU() {
-	var oldestKey string
-	var oldestTime int64 = time.Now().Unix()
-
-	for key, item := range llmCache {
-		if item.LastAccessed < oldestTime {
-			oldestTime = item.LastAccessed
-			oldestKey = key
 		}
 	}
 
-	if oldestKey != "" {
-		delete(llmCache, oldestKey)
-		llmCacheStats.Evictions++
-		logger.Debugf(context.Background(), "evicted LLM cache item: %s", oldestKey)
-	}
+	return item
 }
 
-// cleanExpiredCache 清理过期缓存
+// cleanExpiredCache 每5分钟遍历一次后端，删除已超出ExpiresAt+LLMCacheStaleWindow的
+// 缓存项并把它们从语义索引中移除。容量淘汰策略（LRU等）由当前使用的LLMCacheBackend实现决定。
 func cleanExpiredCache() {
 	ticker := time.NewTicker(5 * time.Minute)
 	defer ticker.Stop()
 
 	for range ticker.C {
 		now := time.Now().Unix()
-		llmCacheMutex.Lock()
-
-		for key, item := range llmCache {
+		var expiredKeys []string
+		llmCacheBackend.Iterate(func(key string, item *LLMCacheItem) bool {
+			// stale窗口内的项仍可作为stale响应返回，留到窗口结束后再清理
+			if now <= item.ExpiresAt+LLMCacheStaleWindow {
+				return true
+			}
 			if now > item.ExpiresAt {
-				delete(llmCache, key)
-				llmCacheStats.TotalItems--
-				logger.Debugf(context.Background(), "cleaned expired LLM cache item: %s", key)
+				expiredKeys = append(expiredKeys, key)
 			}
+			return true
+		})
+		for _, key := range expiredKeys {
+			llmCacheBackend.Delete(key)
+			pruneSemanticIndex(key)
+			logger.Debugf(context.Background(), "cleaned expired LLM cache item: %s", key)
 		}
-
-		llmCacheMutex.Unlock()
 	}
 }
 
 // GetLLMCacheStats 获取缓存统计
 func GetLLMCacheStats() *LLMCacheStats {
-	llmCacheMutex.RLock()
-	defer llmCacheMutex.RUnlock()
+	stats := llmCacheBackend.Stats()
+
+	llmCoalesceStatsMu.Lock()
+	stats.InFlight = llmInFlightCount
+	stats.CoalescedHits = llmCoalescedHits
+	llmCoalesceStatsMu.Unlock()
 
-	stats := *llmCacheStats
-	stats.TotalItems = int64(len(llmCache))
-	stats.MaxSize = int64(LLMCacheMaxSize)
 	return &stats
 }
 
 // ClearLLMCache 清空缓存
 func ClearLLMCache() {
-	llmCacheMutex.Lock()
-	defer llmCacheMutex.Unlock()
-
-	llmCache = make(map[string]*LLMCacheItem)
-	llmCacheStats = &LLMCacheStats{}
-
-	// 如果Redis可用，也清空Redis中的缓存
-	if common.RedisEnabled {
-		go func() {
-			keys, err := common.RedisKeys("llm_cache:*")
-			if err == nil {
-				for _, key := range keys {
-					common.RedisDel(key)
-				}
-			}
-		}()
-	}
+	llmCacheBackend.Clear()
 
 	logger.SysLog("LLM cache cleared")
 }
 
 // GetLLMCacheConfig 获取缓存配置
 func GetLLMCacheConfig() LLMCacheConfig {
-	llmCacheMutex.RLock()
-	defer llmCacheMutex.RUnlock()
+	llmCacheConfigMutex.RLock()
+	defer llmCacheConfigMutex.RUnlock()
 	return llmCacheConfig
 }
 
 // GetLLMCacheItems 获取缓存项列表（用于管理界面）
 func GetLLMCacheItems() []*LLMCacheItem {
-	llmCacheMutex.RLock()
-	defer llmCacheMutex.RUnlock()
-
-	items := make([]*LLMCacheItem, 0, len(llmCache))
-	for _, item := range llmCache {
+	var items []*LLMCacheItem
+	llmCacheBackend.Iterate(func(key string, item *LLMCacheItem) bool {
 		items = append(items, item)
-	}
+		return true
+	})
 	return items
 }
 
 // DeleteLLMCacheItem 删除指定缓存项
 func DeleteLLMCacheItem(key string) {
-	llmCacheMutex.Lock()
-	defer llmCacheMutex.Unlock()
+	llmCacheBackend.Delete(key)
+	pruneSemanticIndex(key)
 
-	if _, exists := llmCache[key]; exists {
-		delete(llmCache, key)
-		llmCacheStats.TotalItems--
-
-		// 如果Redis可用，也从Redis删除
-		if common.RedisEnabled {
-			go common.RedisDel(key)
-		}
-
-		logger.Debugf(context.Background(), "LLM cache item deleted: %s", key)
-	}
+	logger.Debugf(context.Background(), "LLM cache item deleted: %s", key)
 }
 
 // UpdateLLMCacheConfig 更新缓存配置
 func UpdateLLMCacheConfig(config LLMCacheConfig) {
-	llmCacheMutex.Lock()
-	defer llmCacheMutex.Unlock()
-
+	llmCacheConfigMutex.Lock()
 	llmCacheConfig = config
+	llmCacheConfigMutex.Unlock()
 
 	// 如果禁用了缓存，清空现有缓存
 	if !config.Enabled {
-		llmCache = make(map[string]*LLMCacheItem)
-		llmCacheStats = &LLMCacheStats{}
+		llmCacheBackend.Clear()
 	}
 
 	logger.SysLog("LLM cache config updated")
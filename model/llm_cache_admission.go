@@ -0,0 +1,605 @@
+package model
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+)
+
+// LLMCacheEvictionPolicy 选择内存缓存分片内部使用的淘汰策略
+const (
+	LLMCacheEvictionLRU     = "lru"
+	LLMCacheEvictionTinyLFU = "tinylfu"
+	LLMCacheEvictionS3FIFO  = "s3fifo"
+)
+
+var (
+	// LLMCacheEvictionPolicy 默认沿用原有的LRU策略，保持行为不变；
+	// 设置为tinylfu/s3fifo可以在10k+条目规模下获得更高的命中率与更低的淘汰开销。
+	LLMCacheEvictionPolicy = LLMCacheEvictionLRU
+
+	// LLMCacheShardCount 分片数量，每个分片拥有独立的锁与独立的淘汰引擎实例，
+	// 避免所有Get/Set竞争同一把全局写锁。
+	LLMCacheShardCount = 32
+
+	// LLMCacheModelPriceRatio 按模型名配置的单位token价格（任意货币单位/token），
+	// 用于让准入策略按"节省的钱"而不是单纯的访问次数来计分。未配置的模型退化为按
+	// 访问次数计分（权重为1）。
+	LLMCacheModelPriceRatio = map[string]float64{}
+)
+
+// itemWeight 返回一次命中该item应计入频率统计的权重。配置了价格表时按
+// tokens*price折算成一个有界的整数权重，否则退化为权重1（等价于传统LFU）。
+func itemWeight(item *LLMCacheItem) uint32 {
+	if item == nil || item.Usage == nil {
+		return 1
+	}
+	price, ok := LLMCacheModelPriceRatio[item.Model]
+	if !ok || price <= 0 {
+		return 1
+	}
+	cost := float64(item.Usage.TotalTokens) * price
+	weight := uint32(cost)
+	if weight < 1 {
+		weight = 1
+	}
+	if weight > 255 {
+		weight = 255
+	}
+	return weight
+}
+
+// evictionEngine 是单个分片内部实际持有条目并决定淘汰顺序的引擎，
+// LRU/TinyLFU/S3-FIFO都实现这个接口。调用方需要自行加锁，引擎本身不是并发安全的。
+type evictionEngine interface {
+	get(key string) (*LLMCacheItem, bool)
+	set(key string, item *LLMCacheItem)
+	delete(key string)
+	iterate(fn func(key string, item *LLMCacheItem) bool)
+	clear()
+	len() int
+	evictions() int64
+}
+
+// admissionReporter 由支持准入统计的引擎（目前是TinyLFU）额外实现
+type admissionReporter interface {
+	admissionStats() (estimatedHitRate, admissionRate float64)
+}
+
+func newEvictionEngine(policy string, capacity int) evictionEngine {
+	switch policy {
+	case LLMCacheEvictionTinyLFU:
+		return newTinyLFUEngine(capacity)
+	case LLMCacheEvictionS3FIFO:
+		return newS3FIFOEngine(capacity)
+	default:
+		return newLRUEngine(capacity)
+	}
+}
+
+// ---------------------------------------------------------------------------
+// lruEngine: 用container/list维护访问顺序的O(1) LRU，替代旧版evictLRU()里
+// 每次淘汰都要全量扫描map找最旧entry的O(n)实现
+// ---------------------------------------------------------------------------
+
+type lruEngine struct {
+	capacity      int
+	ll            *list.List
+	index         map[string]*list.Element
+	evictionCount int64
+}
+
+type lruEntry struct {
+	key  string
+	item *LLMCacheItem
+}
+
+func newLRUEngine(capacity int) *lruEngine {
+	return &lruEngine{
+		capacity: capacity,
+		ll:       list.New(),
+		index:    make(map[string]*list.Element),
+	}
+}
+
+func (e *lruEngine) get(key string) (*LLMCacheItem, bool) {
+	el, ok := e.index[key]
+	if !ok {
+		return nil, false
+	}
+	e.ll.MoveToFront(el)
+	return el.Value.(*lruEntry).item, true
+}
+
+func (e *lruEngine) set(key string, item *LLMCacheItem) {
+	if el, ok := e.index[key]; ok {
+		el.Value.(*lruEntry).item = item
+		e.ll.MoveToFront(el)
+		return
+	}
+
+	if e.capacity > 0 && len(e.index) >= e.capacity {
+		e.evictOldest()
+	}
+
+	el := e.ll.PushFront(&lruEntry{key: key, item: item})
+	e.index[key] = el
+}
+
+func (e *lruEngine) evictOldest() {
+	back := e.ll.Back()
+	if back == nil {
+		return
+	}
+	e.ll.Remove(back)
+	key := back.Value.(*lruEntry).key
+	delete(e.index, key)
+	e.evictionCount++
+	pruneSemanticIndex(key)
+}
+
+func (e *lruEngine) delete(key string) {
+	if el, ok := e.index[key]; ok {
+		e.ll.Remove(el)
+		delete(e.index, key)
+	}
+}
+
+func (e *lruEngine) iterate(fn func(key string, item *LLMCacheItem) bool) {
+	for el := e.ll.Front(); el != nil; el = el.Next() {
+		entry := el.Value.(*lruEntry)
+		if !fn(entry.key, entry.item) {
+			return
+		}
+	}
+}
+
+func (e *lruEngine) clear() {
+	e.ll = list.New()
+	e.index = make(map[string]*list.Element)
+}
+
+func (e *lruEngine) len() int { return len(e.index) }
+
+func (e *lruEngine) evictions() int64 { return e.evictionCount }
+
+// ---------------------------------------------------------------------------
+// countMinSketch: 估计key的访问频率，用于TinyLFU的准入判断
+// ---------------------------------------------------------------------------
+
+const cmSketchDepth = 4
+
+type countMinSketch struct {
+	width    uint64
+	counters [cmSketchDepth][]uint8
+	seeds    [cmSketchDepth]maphash.Seed
+	added    uint64
+	resetAt  uint64
+}
+
+func newCountMinSketch(capacity int) *countMinSketch {
+	width := uint64(capacity * 4)
+	if width < 64 {
+		width = 64
+	}
+	s := &countMinSketch{width: width, resetAt: width * 10}
+	for i := 0; i < cmSketchDepth; i++ {
+		s.counters[i] = make([]uint8, width)
+		s.seeds[i] = maphash.MakeSeed()
+	}
+	return s
+}
+
+func (s *countMinSketch) indexOf(row int, key string) uint64 {
+	var h maphash.Hash
+	h.SetSeed(s.seeds[row])
+	_, _ = h.WriteString(key)
+	return h.Sum64() % s.width
+}
+
+// increment 按权重增加key的估计频率，权重越大代表这次命中越"值钱"
+func (s *countMinSketch) increment(key string, weight uint32) {
+	for row := 0; row < cmSketchDepth; row++ {
+		idx := s.indexOf(row, key)
+		newVal := uint32(s.counters[row][idx]) + weight
+		if newVal > 255 {
+			newVal = 255
+		}
+		s.counters[row][idx] = uint8(newVal)
+	}
+	s.added += uint64(weight)
+	if s.added >= s.resetAt {
+		s.halve()
+	}
+}
+
+func (s *countMinSketch) estimate(key string) uint8 {
+	var min uint8 = 255
+	for row := 0; row < cmSketchDepth; row++ {
+		idx := s.indexOf(row, key)
+		if v := s.counters[row][idx]; v < min {
+			min = v
+		}
+	}
+	return min
+}
+
+// halve 周期性地把所有计数器减半，使sketch能适应访问模式的变化（老化）
+func (s *countMinSketch) halve() {
+	for row := 0; row < cmSketchDepth; row++ {
+		for i, v := range s.counters[row] {
+			s.counters[row][i] = v / 2
+		}
+	}
+	s.added /= 2
+}
+
+// ---------------------------------------------------------------------------
+// tinyLFUEngine: window-LRU + segmented-LRU(probation/protected) + CM sketch，
+// 实现W-TinyLFU准入策略
+// ---------------------------------------------------------------------------
+
+type tinyLFUSegment int
+
+const (
+	segWindow tinyLFUSegment = iota
+	segProbation
+	segProtected
+)
+
+type tinyLFUEntry struct {
+	key     string
+	item    *LLMCacheItem
+	segment tinyLFUSegment
+}
+
+type tinyLFUEngine struct {
+	sketch *countMinSketch
+
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	index     map[string]*list.Element
+
+	windowCap    int
+	mainCap      int
+	protectedCap int
+
+	evictionCount   int64
+	admissions      int64
+	admissionChecks int64
+	hits            int64
+	accesses        int64
+}
+
+func newTinyLFUEngine(capacity int) *tinyLFUEngine {
+	if capacity < 1 {
+		capacity = 1
+	}
+	windowCap := capacity / 100
+	if windowCap < 1 {
+		windowCap = 1
+	}
+	mainCap := capacity - windowCap
+	protectedCap := mainCap * 4 / 5 // 主区80%为protected，20%为probation
+
+	return &tinyLFUEngine{
+		sketch:       newCountMinSketch(capacity),
+		window:       list.New(),
+		probation:    list.New(),
+		protected:    list.New(),
+		index:        make(map[string]*list.Element),
+		windowCap:    windowCap,
+		mainCap:      mainCap,
+		protectedCap: protectedCap,
+	}
+}
+
+func (e *tinyLFUEngine) get(key string) (*LLMCacheItem, bool) {
+	e.accesses++
+	el, ok := e.index[key]
+	if !ok {
+		return nil, false
+	}
+	e.hits++
+	entry := el.Value.(*tinyLFUEntry)
+	e.sketch.increment(key, itemWeight(entry.item))
+
+	switch entry.segment {
+	case segWindow:
+		e.window.MoveToFront(el)
+	case segProbation:
+		e.probation.Remove(el)
+		entry.segment = segProtected
+		newEl := e.protected.PushFront(entry)
+		e.index[key] = newEl
+		e.demoteProtectedOverflow()
+	case segProtected:
+		e.protected.MoveToFront(el)
+	}
+
+	return entry.item, true
+}
+
+func (e *tinyLFUEngine) demoteProtectedOverflow() {
+	for e.protected.Len() > e.protectedCap {
+		back := e.protected.Back()
+		e.protected.Remove(back)
+		entry := back.Value.(*tinyLFUEntry)
+		entry.segment = segProbation
+		e.index[entry.key] = e.probation.PushFront(entry)
+	}
+}
+
+func (e *tinyLFUEngine) set(key string, item *LLMCacheItem) {
+	if el, ok := e.index[key]; ok {
+		el.Value.(*tinyLFUEntry).item = item
+		return
+	}
+
+	e.sketch.increment(key, itemWeight(item))
+
+	entry := &tinyLFUEntry{key: key, item: item, segment: segWindow}
+	e.index[key] = e.window.PushFront(entry)
+
+	for e.window.Len() > e.windowCap {
+		e.evictFromWindow()
+	}
+}
+
+// evictFromWindow 把window淘汰出来的候选项与probation队尾的主区候选项比较
+// 估计频率，胜者留在主区(probation)，败者被直接丢弃
+func (e *tinyLFUEngine) evictFromWindow() {
+	back := e.window.Back()
+	if back == nil {
+		return
+	}
+	e.window.Remove(back)
+	candidate := back.Value.(*tinyLFUEntry)
+	delete(e.index, candidate.key)
+
+	mainVictimEl := e.probation.Back()
+	if mainVictimEl == nil || e.probation.Len()+e.protected.Len() < e.mainCap {
+		// 主区（probation+protected）还没满，或probation里没有可比较的候选，直接准入
+		candidate.segment = segProbation
+		e.index[candidate.key] = e.probation.PushFront(candidate)
+		e.admissions++
+		e.admissionChecks++
+		return
+	}
+
+	mainVictim := mainVictimEl.Value.(*tinyLFUEntry)
+	e.admissionChecks++
+	if e.sketch.estimate(candidate.key) > e.sketch.estimate(mainVictim.key) {
+		e.probation.Remove(mainVictimEl)
+		delete(e.index, mainVictim.key)
+		e.evictionCount++
+		pruneSemanticIndex(mainVictim.key)
+
+		candidate.segment = segProbation
+		e.index[candidate.key] = e.probation.PushFront(candidate)
+		e.admissions++
+	} else {
+		e.evictionCount++
+		pruneSemanticIndex(candidate.key)
+	}
+}
+
+func (e *tinyLFUEngine) delete(key string) {
+	el, ok := e.index[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*tinyLFUEntry)
+	switch entry.segment {
+	case segWindow:
+		e.window.Remove(el)
+	case segProbation:
+		e.probation.Remove(el)
+	case segProtected:
+		e.protected.Remove(el)
+	}
+	delete(e.index, key)
+}
+
+func (e *tinyLFUEngine) iterate(fn func(key string, item *LLMCacheItem) bool) {
+	for _, ll := range []*list.List{e.window, e.probation, e.protected} {
+		for el := ll.Front(); el != nil; el = el.Next() {
+			entry := el.Value.(*tinyLFUEntry)
+			if !fn(entry.key, entry.item) {
+				return
+			}
+		}
+	}
+}
+
+func (e *tinyLFUEngine) clear() {
+	e.window = list.New()
+	e.probation = list.New()
+	e.protected = list.New()
+	e.index = make(map[string]*list.Element)
+}
+
+func (e *tinyLFUEngine) len() int { return len(e.index) }
+
+func (e *tinyLFUEngine) evictions() int64 { return e.evictionCount }
+
+func (e *tinyLFUEngine) admissionStats() (estimatedHitRate, admissionRate float64) {
+	if e.accesses > 0 {
+		estimatedHitRate = float64(e.hits) / float64(e.accesses)
+	}
+	if e.admissionChecks > 0 {
+		admissionRate = float64(e.admissions) / float64(e.admissionChecks)
+	}
+	return
+}
+
+// ---------------------------------------------------------------------------
+// s3fifoEngine: small/main/ghost 三个FIFO队列，见S3-FIFO论文
+// ---------------------------------------------------------------------------
+
+type s3fifoEntry struct {
+	key  string
+	item *LLMCacheItem
+	freq uint8 // 0~3，命中时自增，淘汰扫描时作为"再给一次机会"的依据
+}
+
+type s3fifoEngine struct {
+	small *list.List
+	main  *list.List
+	index map[string]*list.Element
+
+	ghost     map[string]struct{}
+	ghostFIFO *list.List
+
+	smallCap int
+	mainCap  int
+	ghostCap int
+
+	evictionCount int64
+}
+
+func newS3FIFOEngine(capacity int) *s3fifoEngine {
+	if capacity < 1 {
+		capacity = 1
+	}
+	smallCap := capacity / 10
+	if smallCap < 1 {
+		smallCap = 1
+	}
+	return &s3fifoEngine{
+		small:     list.New(),
+		main:      list.New(),
+		index:     make(map[string]*list.Element),
+		ghost:     make(map[string]struct{}),
+		ghostFIFO: list.New(),
+		smallCap:  smallCap,
+		mainCap:   capacity - smallCap,
+		ghostCap:  capacity,
+	}
+}
+
+func (e *s3fifoEngine) get(key string) (*LLMCacheItem, bool) {
+	el, ok := e.index[key]
+	if !ok {
+		return nil, false
+	}
+	entry := el.Value.(*s3fifoEntry)
+	if entry.freq < 3 {
+		entry.freq++
+	}
+	return entry.item, true
+}
+
+func (e *s3fifoEngine) set(key string, item *LLMCacheItem) {
+	if el, ok := e.index[key]; ok {
+		el.Value.(*s3fifoEntry).item = item
+		return
+	}
+
+	_, wasGhost := e.ghost[key]
+	if wasGhost {
+		delete(e.ghost, key)
+	}
+
+	for e.small.Len()+e.main.Len() >= e.smallCap+e.mainCap {
+		e.evictOne()
+	}
+
+	entry := &s3fifoEntry{key: key, item: item}
+	if wasGhost {
+		e.index[key] = e.main.PushFront(entry)
+	} else {
+		e.index[key] = e.small.PushFront(entry)
+	}
+}
+
+// evictOne 按S3-FIFO的规则淘汰一项：优先检查small队尾，freq>0的给一次机会晋升到
+// main，freq==0的直接淘汰并记入ghost；small为空时改为在main队尾做CLOCK式淘汰。
+func (e *s3fifoEngine) evictOne() {
+	if e.small.Len() > 0 {
+		back := e.small.Back()
+		entry := back.Value.(*s3fifoEntry)
+		e.small.Remove(back)
+		if entry.freq > 0 {
+			entry.freq = 0
+			e.index[entry.key] = e.main.PushFront(entry)
+			return
+		}
+		delete(e.index, entry.key)
+		e.addGhost(entry.key)
+		e.evictionCount++
+		pruneSemanticIndex(entry.key)
+		return
+	}
+
+	for e.main.Len() > 0 {
+		back := e.main.Back()
+		entry := back.Value.(*s3fifoEntry)
+		if entry.freq > 0 {
+			entry.freq--
+			e.main.MoveToFront(back)
+			continue
+		}
+		e.main.Remove(back)
+		delete(e.index, entry.key)
+		e.evictionCount++
+		pruneSemanticIndex(entry.key)
+		return
+	}
+}
+
+func (e *s3fifoEngine) addGhost(key string) {
+	if e.ghostFIFO.Len() >= e.ghostCap {
+		oldest := e.ghostFIFO.Back()
+		if oldest != nil {
+			e.ghostFIFO.Remove(oldest)
+			delete(e.ghost, oldest.Value.(string))
+		}
+	}
+	e.ghost[key] = struct{}{}
+	e.ghostFIFO.PushFront(key)
+}
+
+func (e *s3fifoEngine) delete(key string) {
+	el, ok := e.index[key]
+	if !ok {
+		return
+	}
+	entry := el.Value.(*s3fifoEntry)
+	if entry.freq >= 0 {
+		// 不知道条目具体在哪个队列里，两边各尝试移除一次
+		e.small.Remove(el)
+		e.main.Remove(el)
+	}
+	delete(e.index, key)
+}
+
+func (e *s3fifoEngine) iterate(fn func(key string, item *LLMCacheItem) bool) {
+	for _, ll := range []*list.List{e.small, e.main} {
+		for el := ll.Front(); el != nil; el = el.Next() {
+			entry := el.Value.(*s3fifoEntry)
+			if !fn(entry.key, entry.item) {
+				return
+			}
+		}
+	}
+}
+
+func (e *s3fifoEngine) clear() {
+	e.small = list.New()
+	e.main = list.New()
+	e.index = make(map[string]*list.Element)
+	e.ghost = make(map[string]struct{})
+	e.ghostFIFO = list.New()
+}
+
+func (e *s3fifoEngine) len() int { return len(e.index) }
+
+func (e *s3fifoEngine) evictions() int64 { return e.evictionCount }
+
+// shardLock 是shardedMemoryStore里每个分片各自的锁+引擎
+type shardLock struct {
+	mu     sync.Mutex
+	engine evictionEngine
+}
@@ -0,0 +1,125 @@
+package model
+
+import "testing"
+
+func TestCountMinSketchHalvesAfterResetThreshold(t *testing.T) {
+	s := newCountMinSketch(16)
+
+	for i := uint64(0); i < s.resetAt; i++ {
+		s.increment("hot-key", 1)
+	}
+
+	if s.added >= s.resetAt {
+		t.Fatalf("expected added counter to have been halved below resetAt, got %d (resetAt=%d)", s.added, s.resetAt)
+	}
+	if got := s.estimate("hot-key"); got >= 255 {
+		t.Fatalf("expected sketch counters to have aged down via halve(), estimate is still saturated at %d", got)
+	}
+}
+
+func TestTinyLFUWindowEvictionAdmitsFirstCandidateIntoProbation(t *testing.T) {
+	e := newTinyLFUEngine(100) // windowCap = 100/100 = 1
+
+	e.set("a", &LLMCacheItem{})
+	e.set("b", &LLMCacheItem{}) // window overflows, "a" is evicted; probation is empty so it's admitted directly
+
+	if e.window.Len() != 1 {
+		t.Fatalf("expected window to hold 1 entry after eviction, got %d", e.window.Len())
+	}
+	if e.probation.Len() != 1 {
+		t.Fatalf("expected probation to hold 1 entry, got %d", e.probation.Len())
+	}
+
+	el, ok := e.index["a"]
+	if !ok {
+		t.Fatalf("expected evicted window entry \"a\" to still be tracked in probation")
+	}
+	if entry := el.Value.(*tinyLFUEntry); entry.segment != segProbation {
+		t.Fatalf("expected \"a\" to be in segProbation, got %v", entry.segment)
+	}
+}
+
+func TestTinyLFUGetPromotesProbationEntryToProtected(t *testing.T) {
+	e := newTinyLFUEngine(100)
+	e.set("a", &LLMCacheItem{})
+	e.set("b", &LLMCacheItem{}) // evicts "a" from window straight into probation
+
+	if _, found := e.get("a"); !found {
+		t.Fatalf("expected \"a\" to still be present after window eviction into probation")
+	}
+
+	el, ok := e.index["a"]
+	if !ok {
+		t.Fatalf("expected \"a\" to remain indexed after get()")
+	}
+	if entry := el.Value.(*tinyLFUEntry); entry.segment != segProtected {
+		t.Fatalf("expected get() on a probation entry to promote it to segProtected, got %v", entry.segment)
+	}
+	if e.protected.Len() != 1 {
+		t.Fatalf("expected protected list to hold the promoted entry, got len=%d", e.protected.Len())
+	}
+}
+
+func TestTinyLFUDemoteProtectedOverflow(t *testing.T) {
+	e := newTinyLFUEngine(10) // protectedCap = (10-1)*4/5 = 7
+
+	// 绕开set/get的准入流程，直接构造一个超过protectedCap的protected队列，
+	// 用来单独验证demoteProtectedOverflow按队尾淘汰到probation的行为
+	overflow := 2
+	for i := 0; i < e.protectedCap+overflow; i++ {
+		key := string(rune('a' + i))
+		entry := &tinyLFUEntry{key: key, item: &LLMCacheItem{}, segment: segProtected}
+		e.index[key] = e.protected.PushFront(entry)
+	}
+
+	e.demoteProtectedOverflow()
+
+	if e.protected.Len() != e.protectedCap {
+		t.Fatalf("expected protected list trimmed back to protectedCap=%d, got %d", e.protectedCap, e.protected.Len())
+	}
+	if e.probation.Len() != overflow {
+		t.Fatalf("expected %d overflowed entries demoted into probation, got %d", overflow, e.probation.Len())
+	}
+	for el := e.probation.Front(); el != nil; el = el.Next() {
+		if entry := el.Value.(*tinyLFUEntry); entry.segment != segProbation {
+			t.Fatalf("expected demoted entry %q to have segment updated to segProbation, got %v", entry.key, entry.segment)
+		}
+	}
+}
+
+func TestS3FIFOGivesSmallQueueEntrySecondChanceBeforeEviction(t *testing.T) {
+	e := newS3FIFOEngine(2) // smallCap=1, mainCap=1
+
+	e.set("a", &LLMCacheItem{})
+	if _, found := e.get("a"); !found {
+		t.Fatalf("expected \"a\" to be found right after set()")
+	}
+	e.set("b", &LLMCacheItem{})
+	e.set("c", &LLMCacheItem{}) // triggers eviction: "a" (freq>0) is promoted to main, "b" (freq==0) is evicted to ghost
+
+	if _, ok := e.ghost["b"]; !ok {
+		t.Fatalf("expected \"b\" (never accessed) to be evicted straight into the ghost set")
+	}
+	if _, ok := e.index["b"]; ok {
+		t.Fatalf("expected \"b\" to no longer be indexed after eviction")
+	}
+
+	el, ok := e.index["a"]
+	if !ok {
+		t.Fatalf("expected \"a\" (accessed once) to survive via its second chance")
+	}
+	entry := el.Value.(*s3fifoEntry)
+	if entry.freq != 0 {
+		t.Fatalf("expected second-chance promotion to main to reset freq to 0, got %d", entry.freq)
+	}
+	found := false
+	for mEl := e.main.Front(); mEl != nil; mEl = mEl.Next() {
+		if mEl.Value.(*s3fifoEntry).key == "a" {
+			found = true
+			break
+		}
+	}
+	if !found {
+		t.Fatalf("expected \"a\" to have been moved into the main queue")
+	}
+}
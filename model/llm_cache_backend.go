@@ -0,0 +1,476 @@
+package model
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/songquanpeng/one-api/common"
+	"github.com/songquanpeng/one-api/common/logger"
+)
+
+// LLMCacheBackendType 缓存后端类型
+const (
+	LLMCacheBackendMemory  = "memory"
+	LLMCacheBackendRedis   = "redis"
+	LLMCacheBackendTwoTier = "two_tier"
+)
+
+// LLMCacheBackend 缓存后端抽象接口，屏蔽内存/Redis/两级缓存的实现差异
+type LLMCacheBackend interface {
+	Get(key string) (*LLMCacheItem, bool)
+	Set(key string, item *LLMCacheItem)
+	Delete(key string)
+	// Iterate 对每一项调用fn，fn返回false时提前终止遍历。注意Redis/两级后端的
+	// Iterate只覆盖本地热点子集而非Redis中的全量key，DeleteByTag不能依赖它，
+	// 需要各后端自行实现能覆盖全量数据的删除逻辑
+	Iterate(fn func(key string, item *LLMCacheItem) bool)
+	// DeleteByTag 删除所有tag=value的缓存项，返回被删除的key列表
+	DeleteByTag(tag, value string) []string
+	Clear()
+	Stats() LLMCacheStats
+}
+
+// newLLMCacheBackend 根据配置创建对应的缓存后端
+func newLLMCacheBackend(backendType string) LLMCacheBackend {
+	switch backendType {
+	case LLMCacheBackendRedis:
+		return newRedisBackend()
+	case LLMCacheBackendTwoTier:
+		return newTwoTierBackend()
+	default:
+		return newMemoryBackend()
+	}
+}
+
+// ---------------------------------------------------------------------------
+// memoryBackend: 分片存储 + 可插拔淘汰引擎（LRU/TinyLFU/S3-FIFO）
+// ---------------------------------------------------------------------------
+//
+// 旧实现用一把全局mu保护单个map，Set在淘汰时还要对全量map做O(n)扫描找最旧
+// entry，在万级条目规模下这把锁会成为所有请求的瓶颈。现在把存储按key哈希
+// 切成LLMCacheShardCount个分片，每个分片各自持有一把锁和一个独立的
+// evictionEngine实例，不同分片之间的Get/Set完全不互相阻塞；淘汰策略本身也
+// 从O(n)全扫描换成了O(1)的list操作（以及TinyLFU的准入判断）。
+
+// memoryBackend 纯内存缓存后端，内部按分片隔离锁与淘汰引擎
+type memoryBackend struct {
+	shards  []*shardLock
+	hits    int64
+	misses  int64
+	statsMu sync.Mutex
+}
+
+func newMemoryBackend() *memoryBackend {
+	shardCount := LLMCacheShardCount
+	if shardCount < 1 {
+		shardCount = 1
+	}
+	perShardCap := LLMCacheMaxSize / shardCount
+	if perShardCap < 1 {
+		perShardCap = 1
+	}
+
+	b := &memoryBackend{shards: make([]*shardLock, shardCount)}
+	for i := range b.shards {
+		b.shards[i] = &shardLock{engine: newEvictionEngine(LLMCacheEvictionPolicy, perShardCap)}
+	}
+	return b
+}
+
+// shardFor 用FNV-1a对key做哈希后取模，决定key落在哪个分片
+func (b *memoryBackend) shardFor(key string) *shardLock {
+	var h uint32 = 2166136261
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= 16777619
+	}
+	return b.shards[h%uint32(len(b.shards))]
+}
+
+func (b *memoryBackend) Get(key string) (*LLMCacheItem, bool) {
+	shard := b.shardFor(key)
+
+	shard.mu.Lock()
+	item, exists := shard.engine.get(key)
+	if !exists {
+		shard.mu.Unlock()
+		b.statsMu.Lock()
+		b.misses++
+		b.statsMu.Unlock()
+		return nil, false
+	}
+
+	// 过期时间之外还要再等StaleWindow秒才算硬过期，在此之前仍返回给调用方，
+	// 由中间件（serveFromCache）根据IsLLMCacheItemStale决定是否以stale响应处理
+	if time.Now().Unix() > item.ExpiresAt+LLMCacheStaleWindow {
+		shard.engine.delete(key)
+		pruneSemanticIndex(key)
+		shard.mu.Unlock()
+
+		b.statsMu.Lock()
+		b.misses++
+		b.statsMu.Unlock()
+		return nil, false
+	}
+
+	// item指针在同一分片的并发Get之间是共享的，HitCount/LastAccessed的写入必须
+	// 在持有shard锁期间完成，否则两个并发的Get会在这两个字段上产生数据竞争
+	item.HitCount++
+	item.LastAccessed = time.Now().Unix()
+	shard.mu.Unlock()
+
+	b.statsMu.Lock()
+	b.hits++
+	b.statsMu.Unlock()
+
+	return item, true
+}
+
+func (b *memoryBackend) Set(key string, item *LLMCacheItem) {
+	shard := b.shardFor(key)
+
+	shard.mu.Lock()
+	shard.engine.set(key, item)
+	shard.mu.Unlock()
+}
+
+func (b *memoryBackend) Delete(key string) {
+	shard := b.shardFor(key)
+	shard.mu.Lock()
+	shard.engine.delete(key)
+	shard.mu.Unlock()
+}
+
+func (b *memoryBackend) DeleteByTag(tag, value string) []string {
+	var keys []string
+	b.Iterate(func(key string, item *LLMCacheItem) bool {
+		if tagValue(item, tag) == value {
+			keys = append(keys, key)
+		}
+		return true
+	})
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	return keys
+}
+
+func (b *memoryBackend) Iterate(fn func(key string, item *LLMCacheItem) bool) {
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		stop := false
+		shard.engine.iterate(func(key string, item *LLMCacheItem) bool {
+			if !fn(key, item) {
+				stop = true
+				return false
+			}
+			return true
+		})
+		shard.mu.Unlock()
+		if stop {
+			return
+		}
+	}
+}
+
+func (b *memoryBackend) Clear() {
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		shard.engine.clear()
+		shard.mu.Unlock()
+	}
+
+	b.statsMu.Lock()
+	b.hits, b.misses = 0, 0
+	b.statsMu.Unlock()
+}
+
+func (b *memoryBackend) Stats() LLMCacheStats {
+	var totalItems int
+	var totalEvictions int64
+	var hitRateSum, admissionRateSum float64
+	var reporterCount int
+
+	for _, shard := range b.shards {
+		shard.mu.Lock()
+		totalItems += shard.engine.len()
+		totalEvictions += shard.engine.evictions()
+		if reporter, ok := shard.engine.(admissionReporter); ok {
+			hitRate, admissionRate := reporter.admissionStats()
+			hitRateSum += hitRate
+			admissionRateSum += admissionRate
+			reporterCount++
+		}
+		shard.mu.Unlock()
+	}
+
+	b.statsMu.Lock()
+	stats := LLMCacheStats{
+		Hits:      b.hits,
+		Misses:    b.misses,
+		Evictions: totalEvictions,
+	}
+	b.statsMu.Unlock()
+
+	stats.TotalItems = int64(totalItems)
+	stats.MaxSize = int64(LLMCacheMaxSize)
+	if reporterCount > 0 {
+		stats.EstimatedHitRate = hitRateSum / float64(reporterCount)
+		stats.AdmissionRate = admissionRateSum / float64(reporterCount)
+	}
+	return stats
+}
+
+// ---------------------------------------------------------------------------
+// redisBackend: Redis作为数据源，本地内存只做热点缓存
+// ---------------------------------------------------------------------------
+
+// redisBackend 以Redis为权威数据源的后端。与旧实现的fire-and-forget写入不同，
+// Set会同步写入Redis，只有写入成功后才更新本地热点缓存，避免进程重启时
+// 丢失尚未来得及落盘的写入。
+type redisBackend struct {
+	hot *memoryBackend
+}
+
+func newRedisBackend() *redisBackend {
+	return &redisBackend{hot: newMemoryBackend()}
+}
+
+func (b *redisBackend) Get(key string) (*LLMCacheItem, bool) {
+	if item, found := b.hot.Get(key); found {
+		return item, true
+	}
+
+	if !common.RedisEnabled {
+		return nil, false
+	}
+
+	raw, err := common.RedisGet(key)
+	if err != nil || raw == "" {
+		return nil, false
+	}
+
+	var item LLMCacheItem
+	if err := json.Unmarshal([]byte(raw), &item); err != nil {
+		logger.Errorf(context.Background(), "failed to unmarshal cache item from redis: %s", err.Error())
+		return nil, false
+	}
+	if time.Now().Unix() > item.ExpiresAt+LLMCacheStaleWindow {
+		go common.RedisDel(key)
+		pruneSemanticIndex(key)
+		return nil, false
+	}
+
+	item.HitCount++
+	item.LastAccessed = time.Now().Unix()
+	b.hot.Set(key, &item)
+
+	return &item, true
+}
+
+func (b *redisBackend) Set(key string, item *LLMCacheItem) {
+	if common.RedisEnabled {
+		itemJSON, err := json.Marshal(item)
+		if err != nil {
+			logger.Errorf(context.Background(), "failed to marshal cache item: %s", err.Error())
+			return
+		}
+		// Redis TTL要覆盖到stale窗口结束，否则Redis会在ExpiresAt就把key淘汰掉，
+		// 导致stale-while-revalidate读不到本该仍然可用的旧值
+		ttl := item.ExpiresAt + LLMCacheStaleWindow - time.Now().Unix()
+		if ttl <= 0 {
+			return
+		}
+		// 同步写入Redis，确保Set返回前数据已落盘，不再依赖fire-and-forget goroutine
+		if err := common.RedisSetEx(key, string(itemJSON), int(ttl)); err != nil {
+			logger.Errorf(context.Background(), "failed to write cache item to redis: %s", err.Error())
+			return
+		}
+	}
+
+	b.hot.Set(key, item)
+}
+
+func (b *redisBackend) Delete(key string) {
+	b.hot.Delete(key)
+	if common.RedisEnabled {
+		common.RedisDel(key)
+	}
+}
+
+func (b *redisBackend) Iterate(fn func(key string, item *LLMCacheItem) bool) {
+	// Redis中的key集合规模可能很大，遍历仅覆盖本地热点缓存已知的部分；
+	// 管理界面展示的是抽样结果而非全量。
+	b.hot.Iterate(fn)
+}
+
+// findKeysByTag扫描Redis中的全量llm_cache:*key（而不是本地热点子集），
+// 返回其中在tag维度上匹配value的key。Redis未启用时退化为只看本地热点缓存。
+func (b *redisBackend) findKeysByTag(tag, value string) []string {
+	if !common.RedisEnabled {
+		var keys []string
+		b.hot.Iterate(func(key string, item *LLMCacheItem) bool {
+			if tagValue(item, tag) == value {
+				keys = append(keys, key)
+			}
+			return true
+		})
+		return keys
+	}
+
+	allKeys, err := common.RedisKeys("llm_cache:*")
+	if err != nil {
+		logger.Errorf(context.Background(), "failed to list redis keys for DeleteByTag: %s", err.Error())
+		return nil
+	}
+
+	var matched []string
+	for _, key := range allKeys {
+		raw, err := common.RedisGet(key)
+		if err != nil || raw == "" {
+			continue
+		}
+		var item LLMCacheItem
+		if err := json.Unmarshal([]byte(raw), &item); err != nil {
+			continue
+		}
+		if tagValue(&item, tag) == value {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+func (b *redisBackend) DeleteByTag(tag, value string) []string {
+	keys := b.findKeysByTag(tag, value)
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	return keys
+}
+
+func (b *redisBackend) Clear() {
+	b.hot.Clear()
+	if common.RedisEnabled {
+		keys, err := common.RedisKeys("llm_cache:*")
+		if err == nil {
+			for _, key := range keys {
+				common.RedisDel(key)
+			}
+		}
+	}
+}
+
+func (b *redisBackend) Stats() LLMCacheStats {
+	return b.hot.Stats()
+}
+
+// ---------------------------------------------------------------------------
+// twoTierBackend: 内存 + Redis，通过pub/sub广播失效通知，保持多实例一致
+// ---------------------------------------------------------------------------
+
+const llmCacheInvalidationChannel = "llm_cache:invalidation"
+
+// twoTierBackend 组合内存热点缓存与Redis，写入时两者都更新，删除/清空时
+// 通过Redis pub/sub广播失效事件，使同一部署下的其他one-api实例也能
+// 同步丢弃自己的本地热点缓存，保持多实例之间的一致性。
+type twoTierBackend struct {
+	*redisBackend
+	subscribeOnce sync.Once
+}
+
+func newTwoTierBackend() *twoTierBackend {
+	b := &twoTierBackend{redisBackend: newRedisBackend()}
+	b.subscribeOnce.Do(b.subscribeInvalidation)
+	return b
+}
+
+func (b *twoTierBackend) subscribeInvalidation() {
+	if !common.RedisEnabled {
+		return
+	}
+	go common.RedisSubscribe(llmCacheInvalidationChannel, func(message string) {
+		if message == "*" {
+			b.hot.Clear()
+			return
+		}
+		b.hot.Delete(message)
+	})
+}
+
+func (b *twoTierBackend) Delete(key string) {
+	b.redisBackend.Delete(key)
+	if common.RedisEnabled {
+		common.RedisPublish(llmCacheInvalidationChannel, key)
+	}
+}
+
+func (b *twoTierBackend) DeleteByTag(tag, value string) []string {
+	// 复用redisBackend的全量扫描逻辑找出匹配的key，但删除要走twoTierBackend自己
+	// 的Delete，才能在删除本地热点缓存/Redis之外，同时把失效广播给同一部署下的
+	// 其他实例
+	keys := b.redisBackend.findKeysByTag(tag, value)
+	for _, key := range keys {
+		b.Delete(key)
+	}
+	return keys
+}
+
+func (b *twoTierBackend) Clear() {
+	b.redisBackend.Clear()
+	if common.RedisEnabled {
+		common.RedisPublish(llmCacheInvalidationChannel, "*")
+	}
+}
+
+// ---------------------------------------------------------------------------
+// 按标签失效
+// ---------------------------------------------------------------------------
+
+// LLMCacheTag 标识缓存项可按哪些维度批量失效
+const (
+	LLMCacheTagModel     = "model"
+	LLMCacheTagUserID    = "user_id"
+	LLMCacheTagChannelID = "channel_id"
+	LLMCacheTagGroup     = "group"
+)
+
+// tagValue 返回item在指定tag维度下的取值
+func tagValue(item *LLMCacheItem, tag string) string {
+	switch tag {
+	case LLMCacheTagModel:
+		return item.Model
+	case LLMCacheTagUserID:
+		return item.UserID
+	case LLMCacheTagChannelID:
+		return fmt.Sprintf("%d", item.ChannelID)
+	case LLMCacheTagGroup:
+		return item.Group
+	default:
+		return ""
+	}
+}
+
+// DeleteByTag 删除所有在指定维度上匹配value的缓存项，
+// 用于渠道/用户/分组下线或密钥轮换时做定向失效，而不必清空整个缓存。
+// 具体的扫描方式由后端自己实现：内存后端直接扫本地map即可，Redis/两级后端
+// 则必须扫描Redis中的全量key，不能只依赖本地热点缓存子集，否则未命中过
+// 本地热点的匹配项会被静默遗漏。
+func DeleteByTag(tag, value string) int {
+	if llmCacheBackend == nil {
+		return 0
+	}
+
+	deleted := llmCacheBackend.DeleteByTag(tag, value)
+
+	for _, key := range deleted {
+		pruneSemanticIndex(key)
+	}
+
+	logger.SysLog(fmt.Sprintf("LLM cache deleted %d items by tag %s=%s", len(deleted), tag, value))
+
+	return len(deleted)
+}
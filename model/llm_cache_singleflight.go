@@ -0,0 +1,87 @@
+package model
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+)
+
+var (
+	// LLMCacheCoalesceEnabled 是否对并发的相同请求做合并：同一个cacheKey只放行
+	// 第一个请求回源，其余并发请求等待第一个请求写入缓存后直接复用其结果。
+	LLMCacheCoalesceEnabled = true
+
+	// LLMCacheCoalesceTimeoutSec 等待同一cacheKey的in-flight请求完成的最长时间，
+	// 超时后放弃等待，转为自行回源，避免第一个请求异常卡住时把所有等待者也一起拖死。
+	LLMCacheCoalesceTimeoutSec int64 = 30
+)
+
+var (
+	llmInFlightMu sync.Mutex
+	llmInFlight   = make(map[string]chan struct{})
+
+	llmCoalesceStatsMu sync.Mutex
+	llmInFlightCount   int64
+	llmCoalescedHits   int64
+)
+
+// AcquireInFlight尝试成为cacheKey这次"回源"的负责人。isLeader为true时调用方需要
+// 负责实际回源并在完成后调用release()通知所有等待者；isLeader为false时说明已有
+// 另一个请求在处理同一个cacheKey，调用方应改为在返回的waitCh上等待。
+func AcquireInFlight(cacheKey string) (waitCh <-chan struct{}, isLeader bool, release func()) {
+	llmInFlightMu.Lock()
+	if ch, exists := llmInFlight[cacheKey]; exists {
+		llmInFlightMu.Unlock()
+
+		llmCoalesceStatsMu.Lock()
+		llmInFlightCount++
+		llmCoalesceStatsMu.Unlock()
+
+		return ch, false, nil
+	}
+
+	done := make(chan struct{})
+	llmInFlight[cacheKey] = done
+	llmInFlightMu.Unlock()
+
+	return nil, true, func() {
+		llmInFlightMu.Lock()
+		delete(llmInFlight, cacheKey)
+		llmInFlightMu.Unlock()
+		close(done)
+	}
+}
+
+// WaitInFlight阻塞等待waitCh关闭（即负责回源的请求已完成），最多等待
+// LLMCacheCoalesceTimeoutSec秒；timedOut为true表示等待超时，调用方应放弃合并、
+// 自行回源。
+func WaitInFlight(waitCh <-chan struct{}) (timedOut bool) {
+	select {
+	case <-waitCh:
+		llmCoalesceStatsMu.Lock()
+		llmCoalescedHits++
+		llmCoalesceStatsMu.Unlock()
+		return false
+	case <-time.After(time.Duration(LLMCacheCoalesceTimeoutSec) * time.Second):
+		return true
+	}
+}
+
+// CloneLLMCacheItemResponse返回cacheItem.Response的一份深拷贝，避免多个被合并的
+// 并发请求在各自编码响应时共享同一份底层Choices/Message数据。
+func CloneLLMCacheItemResponse(item *LLMCacheItem) *relaymodel.TextResponse {
+	if item == nil || item.Response == nil {
+		return nil
+	}
+	raw, err := json.Marshal(item.Response)
+	if err != nil {
+		return item.Response
+	}
+	var clone relaymodel.TextResponse
+	if err := json.Unmarshal(raw, &clone); err != nil {
+		return item.Response
+	}
+	return &clone
+}
@@ -0,0 +1,218 @@
+package model
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	relaymodel "github.com/songquanpeng/one-api/relay/model"
+)
+
+// LLMCacheStreamReplayPacing 回放SSE缓存帧时使用的节奏
+const (
+	LLMCacheStreamPacingInstant  = "instant"  // 尽快回放，不还原帧间时间间隔
+	LLMCacheStreamPacingRecorded = "recorded" // 按录制时的帧间隔回放，给客户端保留"打字机"观感
+)
+
+var (
+	// LLMCacheStreamEnabled 是否允许缓存/回放流式(stream=true)请求的SSE响应
+	LLMCacheStreamEnabled = true
+
+	// LLMCacheStreamReplayPacing 回放策略，默认尽快回放
+	LLMCacheStreamReplayPacing = LLMCacheStreamPacingInstant
+
+	// LLMCacheStreamMaxFrameDelayMs 回放单帧之间允许的最大等待时间，避免录制时
+	// 客户端长时间挂起（例如上游偶发抖动）被原样重放给后续所有命中的请求
+	LLMCacheStreamMaxFrameDelayMs int64 = 2000
+)
+
+// streamToolCallDelta 对应SSE增量中choices[].delta.tool_calls[]的一项，
+// 多个chunk会按index携带同一个tool_call的不同片段（通常是function.arguments的拼接）
+type streamToolCallDelta struct {
+	Index    int    `json:"index"`
+	Id       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function,omitempty"`
+}
+
+type streamDelta struct {
+	Role      string                `json:"role,omitempty"`
+	Content   string                `json:"content,omitempty"`
+	ToolCalls []streamToolCallDelta `json:"tool_calls,omitempty"`
+}
+
+type streamChoice struct {
+	Index        int         `json:"index"`
+	Delta        streamDelta `json:"delta"`
+	FinishReason *string     `json:"finish_reason"`
+}
+
+type streamChunk struct {
+	Id      string              `json:"id"`
+	Object  string              `json:"object"`
+	Created int64               `json:"created"`
+	Model   string              `json:"model"`
+	Choices []streamChoice      `json:"choices"`
+	Usage   *relaymodel.Usage   `json:"usage,omitempty"`
+	Error   *streamErrorPayload `json:"error,omitempty"`
+}
+
+type streamErrorPayload struct {
+	Message string `json:"message"`
+	Type    string `json:"type"`
+}
+
+// splitSSEFrame从单个SSE data frame（形如"data: {...}\n\n"或"data: [DONE]\n\n"）中
+// 取出data负载，frame不是一个合法的data frame时ok返回false
+func splitSSEFrame(frame string) (payload string, ok bool) {
+	line := strings.TrimSpace(frame)
+	if !strings.HasPrefix(line, "data:") {
+		return "", false
+	}
+	return strings.TrimSpace(strings.TrimPrefix(line, "data:")), true
+}
+
+// AssembleStreamResponse把一次完整的SSE帧序列重新拼装成一个普通的TextResponse，
+// 用于写入缓存，以及在非流式请求（例如经语义索引）命中该缓存项时作为JSON响应返回。frames里任意一帧
+// 携带error payload，或者序列没有以[DONE]正常收尾（例如连接被中途打断），都视为
+// 不完整，ok返回false，调用方应放弃缓存这次响应。请求带n>1时会产生多个choice，
+// 目前不支持拼装多choice结果，一旦帧里出现超过一个choice.Index也会返回false。
+func AssembleStreamResponse(frames []string) (response *relaymodel.TextResponse, usage *relaymodel.Usage, ok bool) {
+	var contentByIndex = map[int]*strings.Builder{}
+	var toolCallArgsByIndex = map[int]*streamToolCallDelta{}
+	var toolCallOrder []int
+	var finishReasonByIndex = map[int]string{}
+	var roleByIndex = map[int]string{}
+	var seenChoiceIndices = map[int]bool{}
+
+	var id, object, modelName string
+	var created int64
+	var sawDone bool
+
+	for _, frame := range frames {
+		payload, isData := splitSSEFrame(frame)
+		if !isData || payload == "" {
+			continue
+		}
+		if payload == "[DONE]" {
+			sawDone = true
+			continue
+		}
+
+		var chunk streamChunk
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			continue
+		}
+		if chunk.Error != nil {
+			return nil, nil, false
+		}
+
+		if id == "" {
+			id, object, modelName, created = chunk.Id, chunk.Object, chunk.Model, chunk.Created
+		}
+		if chunk.Usage != nil {
+			usage = chunk.Usage
+		}
+
+		for _, choice := range chunk.Choices {
+			idx := choice.Index
+			seenChoiceIndices[idx] = true
+			if choice.Delta.Role != "" {
+				roleByIndex[idx] = choice.Delta.Role
+			}
+			if choice.Delta.Content != "" {
+				if contentByIndex[idx] == nil {
+					contentByIndex[idx] = &strings.Builder{}
+				}
+				contentByIndex[idx].WriteString(choice.Delta.Content)
+			}
+			for _, tc := range choice.Delta.ToolCalls {
+				existing, seen := toolCallArgsByIndex[tc.Index]
+				if !seen {
+					copied := tc
+					copied.Function.Arguments = ""
+					toolCallArgsByIndex[tc.Index] = &copied
+					toolCallOrder = append(toolCallOrder, tc.Index)
+					existing = toolCallArgsByIndex[tc.Index]
+				}
+				if tc.Id != "" {
+					existing.Id = tc.Id
+				}
+				if tc.Type != "" {
+					existing.Type = tc.Type
+				}
+				if tc.Function.Name != "" {
+					existing.Function.Name = tc.Function.Name
+				}
+				existing.Function.Arguments += tc.Function.Arguments
+			}
+			if choice.FinishReason != nil {
+				finishReasonByIndex[idx] = *choice.FinishReason
+			}
+		}
+	}
+
+	if !sawDone || len(finishReasonByIndex) == 0 {
+		// 流没有正常以[DONE]收尾、或者没有任何choice给出finish_reason，
+		// 说明是被中途打断或上游异常终止，不应作为一个完整响应缓存下来
+		return nil, nil, false
+	}
+
+	if len(seenChoiceIndices) > 1 {
+		// n>1时每个choice各自的tool_calls.Index是在choice内部编号的，不同choice
+		// 之间会撞号，toolCallArgsByIndex/toolCallOrder没有按choice分开维护，
+		// 强行拼装只会把不同choice的tool call内容混进同一个结果里。这种场景直接
+		// 放弃缓存，比缓存一个内容错乱的响应更安全。
+		return nil, nil, false
+	}
+
+	sort.Ints(toolCallOrder)
+	var toolCalls []relaymodel.Tool
+	for _, idx := range toolCallOrder {
+		tc := toolCallArgsByIndex[idx]
+		toolCalls = append(toolCalls, relaymodel.Tool{
+			Id:   tc.Id,
+			Type: tc.Type,
+			Function: relaymodel.Function{
+				Name:      tc.Function.Name,
+				Arguments: tc.Function.Arguments,
+			},
+		})
+	}
+
+	role := roleByIndex[0]
+	if role == "" {
+		role = "assistant"
+	}
+	var content interface{}
+	if contentByIndex[0] != nil {
+		content = contentByIndex[0].String()
+	}
+	finishReason := finishReasonByIndex[0]
+
+	response = &relaymodel.TextResponse{
+		Id:      id,
+		Object:  object,
+		Created: created,
+		Model:   modelName,
+		Choices: []relaymodel.TextResponseChoice{
+			{
+				Index: 0,
+				Message: relaymodel.Message{
+					Role:      role,
+					Content:   content,
+					ToolCalls: toolCalls,
+				},
+				FinishReason: finishReason,
+			},
+		},
+	}
+	if usage != nil {
+		response.Usage = *usage
+	}
+
+	return response, usage, true
+}
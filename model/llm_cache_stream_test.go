@@ -0,0 +1,160 @@
+package model
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func sseFrame(t *testing.T, chunk streamChunk) string {
+	t.Helper()
+	raw, err := json.Marshal(chunk)
+	if err != nil {
+		t.Fatalf("failed to marshal test chunk: %s", err.Error())
+	}
+	return "data: " + string(raw) + "\n\n"
+}
+
+func TestAssembleStreamResponseStitchesContentAcrossChunks(t *testing.T) {
+	finish := "stop"
+	frames := []string{
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-1", Object: "chat.completion.chunk", Model: "gpt-4",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{Role: "assistant", Content: "Hel"}}},
+		}),
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-1", Object: "chat.completion.chunk", Model: "gpt-4",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{Content: "lo"}}},
+		}),
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-1", Object: "chat.completion.chunk", Model: "gpt-4",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{}, FinishReason: &finish}},
+		}),
+		"data: [DONE]\n\n",
+	}
+
+	response, _, ok := AssembleStreamResponse(frames)
+	if !ok {
+		t.Fatalf("expected a complete stream to assemble successfully")
+	}
+	if len(response.Choices) != 1 {
+		t.Fatalf("expected exactly one choice, got %d", len(response.Choices))
+	}
+	msg := response.Choices[0].Message
+	if msg.Role != "assistant" {
+		t.Fatalf("expected role assistant, got %q", msg.Role)
+	}
+	if content, ok := msg.Content.(string); !ok || content != "Hello" {
+		t.Fatalf("expected stitched content \"Hello\", got %#v", msg.Content)
+	}
+	if response.Choices[0].FinishReason != "stop" {
+		t.Fatalf("expected finish_reason \"stop\", got %q", response.Choices[0].FinishReason)
+	}
+}
+
+func TestAssembleStreamResponseStitchesToolCallArgumentDeltas(t *testing.T) {
+	finish := "tool_calls"
+	frames := []string{
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-2",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{
+				Role: "assistant",
+				ToolCalls: []streamToolCallDelta{
+					{Index: 0, Id: "call_1", Type: "function", Function: struct {
+						Name      string `json:"name,omitempty"`
+						Arguments string `json:"arguments,omitempty"`
+					}{Name: "get_weather", Arguments: `{"loc`}},
+				},
+			}}},
+		}),
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-2",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{
+				ToolCalls: []streamToolCallDelta{
+					{Index: 0, Function: struct {
+						Name      string `json:"name,omitempty"`
+						Arguments string `json:"arguments,omitempty"`
+					}{Arguments: `ation":"SF"}`}},
+				},
+			}}},
+		}),
+		sseFrame(t, streamChunk{
+			Id:      "chatcmpl-2",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{}, FinishReason: &finish}},
+		}),
+		"data: [DONE]\n\n",
+	}
+
+	response, _, ok := AssembleStreamResponse(frames)
+	if !ok {
+		t.Fatalf("expected a complete tool-call stream to assemble successfully")
+	}
+	toolCalls := response.Choices[0].Message.ToolCalls
+	if len(toolCalls) != 1 {
+		t.Fatalf("expected exactly one stitched tool call, got %d", len(toolCalls))
+	}
+	tc := toolCalls[0]
+	if tc.Id != "call_1" || tc.Type != "function" || tc.Function.Name != "get_weather" {
+		t.Fatalf("expected tool call metadata to be carried from its first delta, got %#v", tc)
+	}
+	if tc.Function.Arguments != `{"location":"SF"}` {
+		t.Fatalf("expected tool call arguments stitched across deltas, got %q", tc.Function.Arguments)
+	}
+}
+
+func TestAssembleStreamResponseWithoutDoneIsIncomplete(t *testing.T) {
+	finish := "stop"
+	frames := []string{
+		sseFrame(t, streamChunk{
+			Id:      "chatcmpl-3",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{Role: "assistant", Content: "hi"}, FinishReason: &finish}},
+		}),
+		// 连接中途被打断，没有收到[DONE]收尾帧
+	}
+
+	if _, _, ok := AssembleStreamResponse(frames); ok {
+		t.Fatalf("expected a stream missing the [DONE] sentinel to be treated as incomplete")
+	}
+}
+
+func TestAssembleStreamResponseWithMultipleChoicesIsRejected(t *testing.T) {
+	finish := "stop"
+	frames := []string{
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-5",
+			Choices: []streamChoice{
+				{Index: 0, Delta: streamDelta{Role: "assistant", Content: "hi"}},
+				{Index: 1, Delta: streamDelta{Role: "assistant", Content: "yo"}},
+			},
+		}),
+		sseFrame(t, streamChunk{
+			Id: "chatcmpl-5",
+			Choices: []streamChoice{
+				{Index: 0, Delta: streamDelta{}, FinishReason: &finish},
+				{Index: 1, Delta: streamDelta{}, FinishReason: &finish},
+			},
+		}),
+		"data: [DONE]\n\n",
+	}
+
+	if _, _, ok := AssembleStreamResponse(frames); ok {
+		t.Fatalf("expected a stream with n>1 (multiple choice indices) to be rejected rather than silently dropping choices")
+	}
+}
+
+func TestAssembleStreamResponseWithErrorChunkIsRejected(t *testing.T) {
+	frames := []string{
+		sseFrame(t, streamChunk{
+			Id:      "chatcmpl-4",
+			Choices: []streamChoice{{Index: 0, Delta: streamDelta{Role: "assistant", Content: "hi"}}},
+		}),
+		sseFrame(t, streamChunk{
+			Id:    "chatcmpl-4",
+			Error: &streamErrorPayload{Message: "upstream exploded", Type: "server_error"},
+		}),
+		"data: [DONE]\n\n",
+	}
+
+	if _, _, ok := AssembleStreamResponse(frames); ok {
+		t.Fatalf("expected a stream containing an error chunk to be rejected even though it ends with [DONE]")
+	}
+}